@@ -0,0 +1,117 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"github.com/nats-io/nkeys"
+)
+
+// bindingAccount returns the name of the account the user of a binding
+// belongs to, or an empty string if its role does not exist.
+func bindingAccount(b *spec.NatsBinding, roles map[string]*spec.NatsServiceRole) string {
+	if r, ok := roles[b.Spec.RoleName]; ok {
+		return r.Spec.AccountName
+	}
+	return ""
+}
+
+// bindingTarget returns the credentials a NatsBinding with credentials
+// authentication calls for.
+func bindingTarget(b *spec.NatsBinding, roles map[string]*spec.NatsServiceRole) issuedUser {
+	u := issuedUser{
+		owner:     "binding/" + b.Name,
+		namespace: b.Spec.ServiceAccount.Namespace,
+		secret:    b.CredentialsSecretName(),
+		account:   bindingAccount(b, roles),
+		rotation:  b.Annotations[spec.RotateCredentialsAnnotation],
+	}
+	var perms *spec.UserPermissions
+	if r, ok := roles[b.Spec.RoleName]; ok {
+		perms = r.Spec.Permissions
+	}
+	u.permissions = permissionsHash(perms)
+	return u
+}
+
+// syncBinding writes the credentials of the user of the binding to the
+// namespace of its service account, or the sentinel credentials of its
+// cluster with service account token authentication, and returns the
+// binding status. Pending bindings wait for their previous credentials to
+// be revoked.
+func (c *Controller) syncBinding(b *spec.NatsBinding, role *spec.NatsServiceRole, accounts map[string]*spec.NatsAccount, keys map[string]nkeys.KeyPair, pending bool) spec.BindingStatus {
+	status := b.Status
+	status.Ready = false
+	if err := b.Validate(); err != nil {
+		status.Reason = fmt.Sprintf("invalid spec: %v", err)
+		return status
+	}
+	if role == nil {
+		status.Reason = fmt.Sprintf("role %q not found", b.Spec.RoleName)
+		return status
+	}
+	a, ok := accounts[role.Spec.AccountName]
+	kp, hasKey := keys[role.Spec.AccountName]
+	if !ok || !hasKey {
+		status.Reason = fmt.Sprintf("account %q not found", role.Spec.AccountName)
+		return status
+	}
+	sa := b.Spec.ServiceAccount
+	if len(sa.Name) != 0 {
+		if _, err := c.kclient.ServiceAccounts(sa.Namespace).Get(sa.Name); err != nil {
+			if k8sutil.IsKubernetesResourceNotFoundError(err) {
+				status.Reason = fmt.Sprintf("service account %s/%s not found", sa.Namespace, sa.Name)
+			} else {
+				status.Reason = fmt.Sprintf("failed to get service account %s/%s: %v", sa.Namespace, sa.Name, err)
+			}
+			return status
+		}
+	}
+
+	if b.UsesServiceAccountToken() {
+		status.PublicKey = ""
+		if err := c.syncTokenBinding(b, a); err != nil {
+			status.Reason = err.Error()
+			return status
+		}
+		status.Ready = true
+		status.Reason = ""
+		status.Rotation = b.Annotations[spec.RotateCredentialsAnnotation]
+		return status
+	}
+
+	if pending {
+		status.Reason = errRevocationPending.Error()
+		return status
+	}
+	t := bindingTarget(b, map[string]*spec.NatsServiceRole{role.Name: role}).credsTarget(a)
+	name := fmt.Sprintf("%s/%s", sa.Namespace, sa.Name)
+	pub, err := c.issueUser(name, role.Spec.Permissions, kp, t)
+	if len(pub) != 0 {
+		status.PublicKey = pub
+	}
+	if err != nil {
+		status.Reason = err.Error()
+		return status
+	}
+	status.Ready = true
+	status.Reason = ""
+	status.Rotation = b.Annotations[spec.RotateCredentialsAnnotation]
+	return status
+}
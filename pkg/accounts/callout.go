@@ -0,0 +1,518 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"k8s.io/kubernetes/pkg/api"
+	kunversioned "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	authCalloutSubject = "$SYS.REQ.USER.AUTH"
+
+	authAccountSeedKey = "auth.seed"
+	authServiceSeedKey = "service.seed"
+
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+)
+
+// sentinelPermissions are the permissions of the sentinel users, which
+// clients only connect with to reach the auth callout service.
+var sentinelPermissions = &spec.UserPermissions{
+	Publish:   &spec.SubjectPermission{Deny: []string{">"}},
+	Subscribe: &spec.SubjectPermission{Deny: []string{">"}},
+}
+
+// authCallout is the auth callout service of a cluster with service account
+// authentication. The servers delegate the authentication of the users of
+// its auth account, the sentinel users, to the service, which reviews the
+// service account token of the client and issues it a user JWT in the
+// account of the role the service account is bound to.
+type authCallout struct {
+	logger *logrus.Entry
+
+	kclient     *kunversioned.Client
+	namespace   string
+	clusterName string
+
+	account nkeys.KeyPair
+	service nkeys.KeyPair
+	nc      *nats.Conn
+	// claimsHash identifies the claims of the auth account JWT last pushed.
+	claimsHash string
+
+	mu       sync.Mutex
+	ttl      time.Duration
+	audience string
+	bindings []*spec.NatsBinding
+	roles    map[string]*spec.NatsServiceRole
+	keys     map[string]nkeys.KeyPair
+}
+
+// newAuthCallout loads the keys of the auth account and service of the
+// cluster from their secret, and generates them on first use.
+func newAuthCallout(kclient *kunversioned.Client, ns, clusterName string) (*authCallout, error) {
+	co := &authCallout{
+		logger:      logrus.WithField("pkg", "accounts").WithField("cluster-name", clusterName),
+		kclient:     kclient,
+		namespace:   ns,
+		clusterName: clusterName,
+	}
+	name := k8sutil.AuthCalloutSecretName(clusterName)
+	secret, err := kclient.Secrets(ns).Get(name)
+	if err == nil {
+		if co.account, err = nkeys.FromSeed(secret.Data[authAccountSeedKey]); err != nil {
+			return nil, fmt.Errorf("invalid auth account seed in secret %q: %v", name, err)
+		}
+		if co.service, err = nkeys.FromSeed(secret.Data[authServiceSeedKey]); err != nil {
+			return nil, fmt.Errorf("invalid auth service seed in secret %q: %v", name, err)
+		}
+		return co, nil
+	}
+	if !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return nil, err
+	}
+
+	if co.account, err = nkeys.CreateAccount(); err != nil {
+		return nil, err
+	}
+	if co.service, err = nkeys.CreateUser(); err != nil {
+		return nil, err
+	}
+	accountSeed, _ := co.account.Seed()
+	serviceSeed, _ := co.service.Seed()
+	secret = &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"app":          "nats",
+				"nats_cluster": clusterName,
+			},
+		},
+		Data: map[string][]byte{
+			authAccountSeedKey: accountSeed,
+			authServiceSeedKey: serviceSeed,
+		},
+	}
+	if _, err := kclient.Secrets(ns).Create(secret); err != nil {
+		return nil, err
+	}
+	return co, nil
+}
+
+// pushAccount pushes the JWT of the auth account to the servers if its
+// claims changed since the last push. The service may issue users in the
+// allowed accounts.
+func (co *authCallout) pushAccount(op *Operator, cl *spec.NatsCluster, allowed []string) error {
+	pub, _ := co.account.PublicKey()
+	servicePub, _ := co.service.PublicKey()
+	ac := jwt.NewAccountClaims(pub)
+	ac.Name = "AUTH"
+	ac.Authorization.AuthUsers.Add(servicePub)
+	ac.Authorization.AllowedAccounts.Add(allowed...)
+	hash := claimsHash(op.PublicKey(), ac)
+	if hash == co.claimsHash {
+		return nil
+	}
+
+	token, err := op.SignAccount(ac)
+	if err != nil {
+		return fmt.Errorf("failed to sign auth account JWT: %v", err)
+	}
+	co.logger.Infof("Pushing JWT of the auth account, allowing %d accounts", len(allowed))
+	if err := pushAccount(co.kclient, co.namespace, op, cl, token); err != nil {
+		return fmt.Errorf("failed to push auth account JWT: %v", err)
+	}
+	co.claimsHash = hash
+	return nil
+}
+
+// connect connects the service to the cluster and serves the authorization
+// requests of the servers. The connection is kept until the service is
+// closed.
+func (co *authCallout) connect(cl *spec.NatsCluster) error {
+	pub, _ := co.service.PublicKey()
+	uc := jwt.NewUserClaims(pub)
+	uc.Name = "nats-operator-auth-callout"
+	token, err := uc.Encode(co.account)
+	if err != nil {
+		return err
+	}
+	opt := nats.UserJWT(
+		func() (string, error) { return token, nil },
+		func(nonce []byte) ([]byte, error) { return co.service.Sign(nonce) },
+	)
+	nc, err := connectCluster(co.kclient, co.namespace, cl, opt, nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	if _, err := nc.Subscribe(authCalloutSubject, co.handle); err != nil {
+		nc.Close()
+		return err
+	}
+	co.nc = nc
+	return nil
+}
+
+func (co *authCallout) close() {
+	if co.nc != nil {
+		co.nc.Close()
+	}
+}
+
+// update replaces the policy, bindings, roles and account keys the service
+// authorizes clients with.
+func (co *authCallout) update(policy *spec.ServiceAccountAuthPolicy, bindings []*spec.NatsBinding, roles map[string]*spec.NatsServiceRole, keys map[string]nkeys.KeyPair) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.ttl = time.Duration(policy.UserTTLSeconds) * time.Second
+	if co.ttl == 0 {
+		co.ttl = constants.DefaultServiceAccountUserTTLSeconds * time.Second
+	}
+	co.audience = policy.Audience
+	if len(co.audience) == 0 {
+		co.audience = constants.DefaultServiceAccountTokenAudience
+	}
+	co.bindings = bindings
+	co.roles = roles
+	co.keys = keys
+}
+
+// handle responds to an authorization request with the user JWT of the
+// client, or the reason it is denied.
+func (co *authCallout) handle(msg *nats.Msg) {
+	req, err := jwt.DecodeAuthorizationRequestClaims(string(msg.Data))
+	if err != nil {
+		co.logger.Warningf("Invalid authorization request: %v", err)
+		return
+	}
+	res := jwt.NewAuthorizationResponseClaims(req.UserNkey)
+	res.Audience = req.Server.ID
+	user, err := co.authorize(&req.AuthorizationRequest)
+	if err != nil {
+		co.logger.Infof("Denied client %s of server %s: %v", req.ClientInformation.Host, req.Server.Name, err)
+		res.Error = err.Error()
+	} else {
+		res.Jwt = user
+	}
+	token, err := res.Encode(co.account)
+	if err != nil {
+		co.logger.Warningf("Failed to sign authorization response: %v", err)
+		return
+	}
+	if err := msg.Respond([]byte(token)); err != nil {
+		co.logger.Warningf("Failed to respond to authorization request: %v", err)
+	}
+}
+
+// authorize reviews the service account token of the client, and issues
+// the user JWT of the role its service account is bound to. A client bound
+// to several roles selects one with its user name.
+func (co *authCallout) authorize(req *jwt.AuthorizationRequest) (string, error) {
+	token := req.ConnectOptions.Token
+	if len(token) == 0 {
+		return "", errors.New("no service account token")
+	}
+	co.mu.Lock()
+	audience := co.audience
+	co.mu.Unlock()
+	namespace, name, err := co.reviewToken(token, audience)
+	if err != nil {
+		return "", err
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	roleName, err := co.pickRole(namespace, name, req.ConnectOptions.Username)
+	if err != nil {
+		return "", err
+	}
+	role, ok := co.roles[roleName]
+	if !ok {
+		return "", fmt.Errorf("role %q not found", roleName)
+	}
+	kp, ok := co.keys[role.Spec.AccountName]
+	if !ok {
+		return "", fmt.Errorf("account %q not found", role.Spec.AccountName)
+	}
+	uc := userClaims(namespace+"/"+name, role.Spec.Permissions, req.UserNkey)
+	uc.Expires = time.Now().Add(co.ttl).Unix()
+	return uc.Encode(kp)
+}
+
+// pickRole returns the role the service account is bound to, among the
+// roles matching the requested name if any.
+func (co *authCallout) pickRole(namespace, name, requested string) (string, error) {
+	roles := map[string]bool{}
+	for _, b := range co.bindings {
+		if !b.Matches(namespace, name) {
+			continue
+		}
+		if len(requested) != 0 && b.Spec.RoleName != requested {
+			continue
+		}
+		roles[b.Spec.RoleName] = true
+	}
+	switch len(roles) {
+	case 0:
+		return "", fmt.Errorf("service account %s/%s is not bound to any role", namespace, name)
+	case 1:
+		for r := range roles {
+			return r, nil
+		}
+	}
+	names := make([]string, 0, len(roles))
+	for r := range roles {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("service account %s/%s is bound to several roles (%s), select one with the user name", namespace, name, strings.Join(names, ", "))
+}
+
+// tokenReview is a TokenReview of the authentication API, along with the
+// audiences of the later API versions, which the client does not know.
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool `json:"authenticated"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// reviewToken authenticates a service account token bound to the audience
+// with the TokenReview API, and returns the namespace and name of its
+// service account.
+func (co *authCallout) reviewToken(token, audience string) (string, string, error) {
+	body, err := json.Marshal(&tokenReview{
+		APIVersion: "authentication.k8s.io/v1beta1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: []string{audience}},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	raw, err := co.kclient.AuthenticationClient.Post().Resource("tokenreviews").Body(body).DoRaw()
+	if err != nil {
+		co.logger.Warningf("Failed to review token: %v", err)
+		return "", "", errors.New("failed to review token")
+	}
+	var tr tokenReview
+	if err := json.Unmarshal(raw, &tr); err != nil {
+		co.logger.Warningf("Invalid token review: %v", err)
+		return "", "", errors.New("failed to review token")
+	}
+	return reviewedServiceAccount(&tr.Status, token, audience)
+}
+
+// reviewedServiceAccount returns the namespace and name of the service
+// account a token review authenticated. The token must be bound to the
+// audience: API servers checking audiences report the ones the token is
+// bound to, otherwise the audience claim of the authenticated token is
+// checked, which legacy tokens do not have.
+func reviewedServiceAccount(status *tokenReviewStatus, token, audience string) (string, string, error) {
+	if !status.Authenticated {
+		return "", "", errors.New("invalid token")
+	}
+	audiences := status.Audiences
+	if len(audiences) == 0 {
+		audiences = tokenAudiences(token)
+	}
+	bound := false
+	for _, aud := range audiences {
+		bound = bound || aud == audience
+	}
+	if !bound {
+		return "", "", fmt.Errorf("token is not bound to audience %q", audience)
+	}
+	username := status.User.Username
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountUsernamePrefix), ":")
+	if !strings.HasPrefix(username, serviceAccountUsernamePrefix) || len(parts) != 2 {
+		return "", "", fmt.Errorf("user %q is not a service account", username)
+	}
+	return parts[0], parts[1], nil
+}
+
+// tokenAudiences returns the audience claim of a JWT, which is either a
+// string or a list of strings, without verifying the token.
+func tokenAudiences(token string) []string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	claims := struct {
+		Audience json.RawMessage `json:"aud"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || len(claims.Audience) == 0 {
+		return nil
+	}
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err == nil {
+		return audiences
+	}
+	var audience string
+	if err := json.Unmarshal(claims.Audience, &audience); err == nil && len(audience) != 0 {
+		return []string{audience}
+	}
+	return nil
+}
+
+// syncCallouts runs the auth callout service of the clusters of the
+// accounts which have service account authentication enabled, and stops
+// the services of the other clusters.
+func (c *Controller) syncCallouts(accounts map[string]*spec.NatsAccount, keys map[string]nkeys.KeyPair, roles map[string]*spec.NatsServiceRole, bindings *spec.NatsBindingList) {
+	clusters := map[string]bool{}
+	for name, a := range accounts {
+		if _, ok := keys[name]; ok {
+			clusters[a.Spec.ClusterName] = true
+		}
+	}
+	for name, co := range c.callouts {
+		if !clusters[name] {
+			c.stopCallout(name, co)
+		}
+	}
+
+	for name := range clusters {
+		cl, err := k8sutil.GetClusterTPRObject(c.kclient.RESTClient, c.namespace, name)
+		switch {
+		case err == nil && cl.Spec.Accounts != nil && cl.Spec.Accounts.ServiceAccountAuth != nil:
+			if err := c.syncCallout(cl, accounts, keys, roles, bindings); err != nil {
+				c.logger.Warningf("Failed to run auth callout service of cluster %q: %v", name, err)
+			}
+		case err != nil && !k8sutil.IsKubernetesResourceNotFoundError(err):
+			c.logger.Warningf("Failed to get cluster %q: %v", name, err)
+		default:
+			if co, ok := c.callouts[name]; ok {
+				c.stopCallout(name, co)
+			}
+		}
+	}
+}
+
+// syncCallout starts the auth callout service of the cluster, unless it is
+// running, and updates the accounts and bindings it authorizes clients
+// with.
+func (c *Controller) syncCallout(cl *spec.NatsCluster, accounts map[string]*spec.NatsAccount, keys map[string]nkeys.KeyPair, roles map[string]*spec.NatsServiceRole, bindings *spec.NatsBindingList) error {
+	var allowed []string
+	clusterKeys := map[string]nkeys.KeyPair{}
+	for name, a := range accounts {
+		kp, ok := keys[name]
+		if !ok || a.Spec.ClusterName != cl.Name {
+			continue
+		}
+		pub, _ := kp.PublicKey()
+		allowed = append(allowed, pub)
+		clusterKeys[name] = kp
+	}
+	sort.Strings(allowed)
+	var bound []*spec.NatsBinding
+	for i := range bindings.Items {
+		b := &bindings.Items[i]
+		if !b.UsesServiceAccountToken() || b.Validate() != nil {
+			continue
+		}
+		if r, ok := roles[b.Spec.RoleName]; ok {
+			if _, ok := clusterKeys[r.Spec.AccountName]; ok {
+				bound = append(bound, b)
+			}
+		}
+	}
+
+	op, err := EnsureOperator(c.kclient, c.namespace, cl.Name)
+	if err != nil {
+		return fmt.Errorf("failed to load operator: %v", err)
+	}
+	co, running := c.callouts[cl.Name]
+	if !running {
+		if co, err = newAuthCallout(c.kclient, c.namespace, cl.Name); err != nil {
+			return err
+		}
+	}
+	if err := co.pushAccount(op, cl, allowed); err != nil {
+		return err
+	}
+	if !running {
+		c.logger.Infof("Starting auth callout service of cluster %q", cl.Name)
+		if err := co.connect(cl); err != nil {
+			return err
+		}
+		c.callouts[cl.Name] = co
+	}
+
+	co.update(cl.Spec.Accounts.ServiceAccountAuth, bound, roles, clusterKeys)
+	return nil
+}
+
+func (c *Controller) stopCallout(clusterName string, co *authCallout) {
+	c.logger.Infof("Stopping auth callout service of cluster %q", clusterName)
+	co.close()
+	delete(c.callouts, clusterName)
+}
+
+// syncTokenBinding writes the sentinel credentials of the cluster of the
+// binding to the namespace of its service accounts.
+func (c *Controller) syncTokenBinding(b *spec.NatsBinding, a *spec.NatsAccount) error {
+	co, ok := c.callouts[a.Spec.ClusterName]
+	if !ok {
+		return fmt.Errorf("auth callout service of cluster %q is not running", a.Spec.ClusterName)
+	}
+	t := credsTarget{
+		namespace:  b.Spec.ServiceAccount.Namespace,
+		secret:     k8sutil.SentinelSecretName(a.Spec.ClusterName),
+		ownerLabel: "nats_sentinel",
+		owner:      a.Spec.ClusterName,
+		labels: map[string]string{
+			"app":            "nats",
+			"nats_namespace": c.namespace,
+			"nats_cluster":   a.Spec.ClusterName,
+			"nats_sentinel":  a.Spec.ClusterName,
+		},
+	}
+	_, err := c.issueUser("sentinel", sentinelPermissions, co.account, t)
+	return err
+}
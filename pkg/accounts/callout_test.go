@@ -0,0 +1,207 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+)
+
+func binding(namespace, name, role string) *spec.NatsBinding {
+	b := &spec.NatsBinding{}
+	b.Spec.ServiceAccount = spec.ServiceAccountRef{Namespace: namespace, Name: name}
+	b.Spec.RoleName = role
+	return b
+}
+
+func TestPickRole(t *testing.T) {
+	co := &authCallout{
+		bindings: []*spec.NatsBinding{
+			binding("apps", "web", "reader"),
+			binding("apps", "", "metrics"),
+			binding("jobs", "batch", "writer"),
+			binding("jobs", "batch", "reader"),
+		},
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		sa        string
+		requested string
+		role      string
+		err       bool
+	}{
+		{
+			name:      "not bound",
+			namespace: "other",
+			sa:        "web",
+			err:       true,
+		},
+		{
+			name:      "single role",
+			namespace: "jobs",
+			sa:        "batch",
+			requested: "writer",
+			role:      "writer",
+		},
+		{
+			name:      "namespace binding",
+			namespace: "apps",
+			sa:        "worker",
+			role:      "metrics",
+		},
+		{
+			name:      "several roles",
+			namespace: "jobs",
+			sa:        "batch",
+			err:       true,
+		},
+		{
+			name:      "several roles with namespace binding",
+			namespace: "apps",
+			sa:        "web",
+			err:       true,
+		},
+		{
+			name:      "requested among several",
+			namespace: "apps",
+			sa:        "web",
+			requested: "reader",
+			role:      "reader",
+		},
+		{
+			name:      "requested not bound",
+			namespace: "apps",
+			sa:        "web",
+			requested: "writer",
+			err:       true,
+		},
+	}
+	for _, tt := range tests {
+		role, err := co.pickRole(tt.namespace, tt.sa, tt.requested)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if role != tt.role {
+			t.Errorf("%s: role = %q, want %q", tt.name, role, tt.role)
+		}
+	}
+}
+
+// testToken returns an unsigned JWT with the given claims.
+func testToken(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestReviewedServiceAccount(t *testing.T) {
+	const sa = "system:serviceaccount:apps:web"
+	bound := testToken(`{"aud":["nats"],"sub":"` + sa + `"}`)
+	tests := []struct {
+		name          string
+		authenticated bool
+		username      string
+		audiences     []string
+		token         string
+		namespace     string
+		sa            string
+		err           bool
+	}{
+		{
+			name:     "not authenticated",
+			username: sa,
+			token:    bound,
+			err:      true,
+		},
+		{
+			name:          "audience reviewed",
+			authenticated: true,
+			username:      sa,
+			audiences:     []string{"nats"},
+			token:         "opaque",
+			namespace:     "apps",
+			sa:            "web",
+		},
+		{
+			name:          "other audience reviewed",
+			authenticated: true,
+			username:      sa,
+			audiences:     []string{"https://kubernetes.default.svc"},
+			token:         bound,
+			err:           true,
+		},
+		{
+			name:          "audience claim",
+			authenticated: true,
+			username:      sa,
+			token:         bound,
+			namespace:     "apps",
+			sa:            "web",
+		},
+		{
+			name:          "single audience claim",
+			authenticated: true,
+			username:      sa,
+			token:         testToken(`{"aud":"nats"}`),
+			namespace:     "apps",
+			sa:            "web",
+		},
+		{
+			name:          "legacy token",
+			authenticated: true,
+			username:      sa,
+			token:         testToken(`{"iss":"kubernetes/serviceaccount","sub":"` + sa + `"}`),
+			err:           true,
+		},
+		{
+			name:          "malformed token",
+			authenticated: true,
+			username:      sa,
+			token:         "not.a-token",
+			err:           true,
+		},
+		{
+			name:          "not a service account",
+			authenticated: true,
+			username:      "jane",
+			audiences:     []string{"nats"},
+			token:         bound,
+			err:           true,
+		},
+		{
+			name:          "malformed service account",
+			authenticated: true,
+			username:      "system:serviceaccount:apps",
+			audiences:     []string{"nats"},
+			token:         bound,
+			err:           true,
+		},
+	}
+	for _, tt := range tests {
+		status := &tokenReviewStatus{Authenticated: tt.authenticated, Audiences: tt.audiences}
+		status.User.Username = tt.username
+		namespace, name, err := reviewedServiceAccount(status, tt.token, "nats")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if namespace != tt.namespace || name != tt.sa {
+			t.Errorf("%s: service account = %s/%s, want %s/%s", tt.name, namespace, name, tt.namespace, tt.sa)
+		}
+	}
+}
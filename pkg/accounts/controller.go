@@ -0,0 +1,779 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kunversioned "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	claimsUpdateSubject = "$SYS.REQ.CLAIMS.UPDATE"
+
+	credsKey                = "user.creds"
+	userSeedKey             = "user.seed"
+	claimsHashAnnotationKey = "nats.io/claims-hash"
+	// permissionsHashAnnotationKey and rotationAnnotationKey record the
+	// permissions and the rotation the credentials were issued for.
+	permissionsHashAnnotationKey = "nats.io/permissions-hash"
+	rotationAnnotationKey        = "nats.io/rotation"
+)
+
+var (
+	syncInterval      = 30 * time.Second
+	claimsPushTimeout = 5 * time.Second
+
+	// errRevocationPending is reported by the users waiting for their
+	// previous credentials to be revoked before they are issued new ones.
+	errRevocationPending = errors.New("waiting for the previous credentials to be revoked")
+)
+
+// issuedUser is a user the operator issues credentials to, for a NatsUser
+// or a NatsBinding.
+type issuedUser struct {
+	// owner is the kind and name of the object, e.g. "user/app".
+	owner string
+	// namespace and secret locate the credentials of the user.
+	namespace, secret string
+	account           string
+	// permissions and rotation are what the credentials were issued for,
+	// a change of either replaces the user.
+	permissions, rotation string
+	publicKey             string
+}
+
+// credsTarget returns the secret the credentials of the user are written
+// to, in the given account.
+func (u issuedUser) credsTarget(a *spec.NatsAccount) credsTarget {
+	kind, name := splitOwner(u.owner)
+	return credsTarget{
+		namespace:  u.namespace,
+		secret:     u.secret,
+		ownerLabel: "nats_" + kind,
+		owner:      name,
+		labels: map[string]string{
+			"app":            "nats",
+			"nats_namespace": a.Namespace,
+			"nats_cluster":   a.Spec.ClusterName,
+			"nats_account":   a.Name,
+			"nats_" + kind:   name,
+		},
+		annotations: map[string]string{
+			permissionsHashAnnotationKey: u.permissions,
+			rotationAnnotationKey:        u.rotation,
+		},
+	}
+}
+
+func splitOwner(owner string) (kind, name string) {
+	if i := strings.Index(owner, "/"); i >= 0 {
+		return owner[:i], owner[i+1:]
+	}
+	return "", owner
+}
+
+// credsTarget is the secret the credentials of a user are written to.
+type credsTarget struct {
+	namespace, secret string
+	// ownerLabel and owner identify the object the credentials are issued
+	// for. Secrets not labelled with them, and with the namespace of the
+	// object, belong to someone else and are never overwritten.
+	ownerLabel, owner string
+	labels            map[string]string
+	annotations       map[string]string
+}
+
+// owns tells whether the existing secret holds the credentials of the
+// target.
+func (t credsTarget) owns(secret *api.Secret) bool {
+	l := secret.Labels
+	return l["app"] == "nats" && l["nats_namespace"] == t.labels["nats_namespace"] && l[t.ownerLabel] == t.owner
+}
+
+// Controller issues the JWTs of the NatsAccount, NatsUser and NatsBinding
+// objects of a namespace. Account JWTs are signed by the operator key of
+// their cluster and pushed to its servers. User JWTs are signed by their
+// account key and written to credentials secrets, with the user key.
+//
+// The users are rebuilt from their labelled credentials secrets on each
+// sync. The users no object calls for anymore, including the ones of
+// objects deleted while the operator was not running, are revoked in their
+// account, as are the users whose account, permissions or rotation
+// changed. Their secrets are deleted once the revocation is saved in the
+// account status, and new credentials, with a new key, are issued then.
+// The accounts of deleted NatsAccount objects are revoked as a whole, and
+// their key is deleted.
+//
+// The controller also runs the auth callout service of the clusters with
+// service account authentication.
+type Controller struct {
+	logger *logrus.Entry
+
+	kclient   *kunversioned.Client
+	namespace string
+
+	// callouts are the running auth callout services, by cluster name.
+	callouts map[string]*authCallout
+}
+
+func New(kclient *kunversioned.Client, ns string) *Controller {
+	return &Controller{
+		logger:    logrus.WithField("pkg", "accounts"),
+		kclient:   kclient,
+		namespace: ns,
+		callouts:  map[string]*authCallout{},
+	}
+}
+
+// Run syncs the accounts and users periodically until stopC is closed.
+func (c *Controller) Run(stopC <-chan struct{}) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			for name, co := range c.callouts {
+				c.stopCallout(name, co)
+			}
+			return
+		case <-ticker.C:
+			c.sync()
+		}
+	}
+}
+
+func (c *Controller) sync() {
+	accounts, err := k8sutil.ListAccounts(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list accounts: %v", err)
+		return
+	}
+	users, err := k8sutil.ListUsers(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list users: %v", err)
+		return
+	}
+	roles, err := k8sutil.ListServiceRoles(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list service roles: %v", err)
+		return
+	}
+	bindings, err := k8sutil.ListBindings(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list bindings: %v", err)
+		return
+	}
+
+	byName := make(map[string]*spec.NatsAccount, len(accounts.Items))
+	for i := range accounts.Items {
+		byName[accounts.Items[i].Name] = &accounts.Items[i]
+	}
+	roleByName := make(map[string]*spec.NatsServiceRole, len(roles.Items))
+	for i := range roles.Items {
+		roleByName[roles.Items[i].Name] = &roles.Items[i]
+	}
+
+	issued, err := c.listIssuedUsers()
+	if err != nil {
+		c.logger.Errorf("Failed to list credentials secrets: %v", err)
+		return
+	}
+	// the credentials no object calls for anymore, or for another account,
+	// other permissions or a rotation, are revoked in the account JWTs
+	// pushed below
+	desired := make(map[string]issuedUser, len(users.Items)+len(bindings.Items))
+	for i := range users.Items {
+		u := c.userTarget(&users.Items[i])
+		desired[u.owner] = u
+	}
+	for i := range bindings.Items {
+		if b := &bindings.Items[i]; !b.UsesServiceAccountToken() {
+			u := bindingTarget(b, roleByName)
+			desired[u.owner] = u
+		}
+	}
+	var stale []issuedUser
+	revoked := map[string]bool{}
+	for _, u := range issued {
+		cur := u
+		cur.publicKey = ""
+		if d, ok := desired[u.owner]; ok && d == cur {
+			continue
+		}
+		stale = append(stale, u)
+		if a, ok := byName[u.account]; ok && len(u.publicKey) != 0 && revokeUser(a, u.publicKey) {
+			c.logger.Infof("Revoking %s of account %q", u.owner, a.Name)
+			revoked[a.Name] = true
+		}
+	}
+
+	c.retireAccounts(byName)
+
+	// the keys of all accounts are needed to resolve the imports
+	keys := map[string]nkeys.KeyPair{}
+	for _, a := range byName {
+		if err := a.Validate(); err != nil {
+			continue
+		}
+		kp, err := ensureAccountKey(c.kclient, c.namespace, &a.ObjectMeta, a.Spec.ClusterName)
+		if err != nil {
+			c.logger.Warningf("Failed to get key of account %q: %v", a.Name, err)
+			continue
+		}
+		keys[a.Name] = kp
+	}
+
+	saved := map[string]bool{}
+	for _, a := range byName {
+		status := c.syncAccount(a, keys)
+		if reflect.DeepEqual(status, a.Status) && !revoked[a.Name] {
+			saved[a.Name] = true
+			continue
+		}
+		a.Status = status
+		if err := k8sutil.UpdateAccountTPRObject(c.kclient.RESTClient, c.namespace, a); err != nil {
+			c.logger.Warningf("Failed to update status of account %q: %v", a.Name, err)
+			continue
+		}
+		saved[a.Name] = true
+	}
+	pending := c.deleteStaleUsers(stale, byName, saved)
+
+	for i := range users.Items {
+		u := &users.Items[i]
+		status := c.syncUser(u, byName[u.Spec.AccountName], keys, pending["user/"+u.Name])
+		if reflect.DeepEqual(status, u.Status) {
+			continue
+		}
+		u.Status = status
+		if err := k8sutil.UpdateUserTPRObject(c.kclient.RESTClient, c.namespace, u); err != nil {
+			c.logger.Warningf("Failed to update status of user %q: %v", u.Name, err)
+		}
+	}
+	c.syncCallouts(byName, keys, roleByName, bindings)
+	for i := range bindings.Items {
+		b := &bindings.Items[i]
+		status := c.syncBinding(b, roleByName[b.Spec.RoleName], byName, keys, pending["binding/"+b.Name])
+		if reflect.DeepEqual(status, b.Status) {
+			continue
+		}
+		b.Status = status
+		if err := k8sutil.UpdateBindingTPRObject(c.kclient.RESTClient, c.namespace, b); err != nil {
+			c.logger.Warningf("Failed to update status of binding %q: %v", b.Name, err)
+		}
+	}
+}
+
+// listIssuedUsers returns the users the operator issued credentials to for
+// the objects of the namespace, from their credentials secrets.
+func (c *Controller) listIssuedUsers() ([]issuedUser, error) {
+	list, err := c.kclient.Secrets(api.NamespaceAll).List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			"app":            "nats",
+			"nats_namespace": c.namespace,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var users []issuedUser
+	for i := range list.Items {
+		s := &list.Items[i]
+		u := issuedUser{
+			namespace:   s.Namespace,
+			secret:      s.Name,
+			account:     s.Labels["nats_account"],
+			permissions: s.Annotations[permissionsHashAnnotationKey],
+			rotation:    s.Annotations[rotationAnnotationKey],
+		}
+		switch {
+		case len(s.Labels["nats_user"]) != 0:
+			u.owner = "user/" + s.Labels["nats_user"]
+		case len(s.Labels["nats_binding"]) != 0:
+			u.owner = "binding/" + s.Labels["nats_binding"]
+		default:
+			// e.g. sentinel credentials
+			continue
+		}
+		if kp, err := nkeys.FromSeed(s.Data[userSeedKey]); err == nil {
+			u.publicKey, _ = kp.PublicKey()
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// userTarget returns the credentials a NatsUser calls for.
+func (c *Controller) userTarget(u *spec.NatsUser) issuedUser {
+	return issuedUser{
+		owner:       "user/" + u.Name,
+		namespace:   c.namespace,
+		secret:      u.CredentialsSecretName(),
+		account:     u.Spec.AccountName,
+		permissions: permissionsHash(u.Spec.Permissions),
+	}
+}
+
+// deleteStaleUsers deletes the credentials of the stale users whose
+// revocation is saved in their account status, or whose account is gone.
+// It returns the owners of the others, which are not issued new
+// credentials until then.
+func (c *Controller) deleteStaleUsers(stale []issuedUser, accounts map[string]*spec.NatsAccount, saved map[string]bool) map[string]bool {
+	pending := map[string]bool{}
+	for _, u := range stale {
+		if _, ok := accounts[u.account]; ok && !saved[u.account] {
+			pending[u.owner] = true
+			continue
+		}
+		c.logger.Infof("Deleting credentials of %s in secret %s/%s", u.owner, u.namespace, u.secret)
+		if err := k8sutil.DeleteSecret(c.kclient, u.namespace, u.secret); err != nil {
+			c.logger.Warningf("Failed to delete credentials of %s: %v", u.owner, err)
+			pending[u.owner] = true
+		}
+	}
+	return pending
+}
+
+// revokeUser invalidates the JWTs issued to a user until now, and reports
+// whether the user was not revoked yet.
+func revokeUser(a *spec.NatsAccount, pub string) bool {
+	for _, r := range a.Status.RevokedUsers {
+		if r.PublicKey == pub {
+			return false
+		}
+	}
+	a.Status.RevokedUsers = append(a.Status.RevokedUsers, spec.RevokedUser{
+		PublicKey: pub,
+		Time:      unversioned.Now(),
+	})
+	return true
+}
+
+// retireAccounts revokes the accounts of deleted NatsAccount objects,
+// including the ones deleted while the operator was not running, and
+// deletes their key. The JWT of an account is removed from the preloads of
+// the memory resolver. The full resolver keeps account JWTs, so a JWT
+// revoking all the users of the account, and allowing no connections,
+// replaces the last one.
+func (c *Controller) retireAccounts(accounts map[string]*spec.NatsAccount) {
+	list, err := c.kclient.Secrets(c.namespace).List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{"app": "nats"}),
+	})
+	if err != nil {
+		c.logger.Warningf("Failed to list account keys: %v", err)
+		return
+	}
+	for i := range list.Items {
+		s := &list.Items[i]
+		name := s.Labels["nats_account"]
+		if len(name) == 0 || s.Name != k8sutil.AccountSecretName(name) || len(s.Data[accountSeedKey]) == 0 {
+			continue
+		}
+		uid := s.Annotations[accountUIDAnnotationKey]
+		if a, ok := accounts[name]; ok && (len(uid) == 0 || uid == string(a.UID)) {
+			continue
+		}
+		kp, err := accountKey(s)
+		if err == nil {
+			err = c.revokeAccount(s.Labels["nats_cluster"], name, kp)
+		}
+		if err != nil {
+			c.logger.Warningf("Failed to revoke deleted account %q: %v", name, err)
+			continue
+		}
+		c.logger.Infof("Deleting key of deleted account %q", name)
+		if err := k8sutil.DeleteSecret(c.kclient, c.namespace, s.Name); err != nil {
+			c.logger.Warningf("Failed to delete key of account %q: %v", name, err)
+		}
+	}
+}
+
+// revokeAccount removes the account from the servers of the cluster, if it
+// still has accounts enabled.
+func (c *Controller) revokeAccount(clusterName, name string, kp nkeys.KeyPair) error {
+	cl, err := k8sutil.GetClusterTPRObject(c.kclient.RESTClient, c.namespace, clusterName)
+	if k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get cluster %q: %v", clusterName, err)
+	}
+	if cl.Spec.Accounts == nil {
+		return nil
+	}
+	pub, _ := kp.PublicKey()
+	if cl.Spec.Accounts.MemoryResolver() {
+		c.logger.Infof("Removing JWT of deleted account %q from cluster %q", name, cl.Name)
+		return storeAccount(c.kclient, c.namespace, cl.Name, pub, "")
+	}
+	op, err := EnsureOperator(c.kclient, c.namespace, cl.Name)
+	if err != nil {
+		return fmt.Errorf("failed to load operator: %v", err)
+	}
+	ac := jwt.NewAccountClaims(pub)
+	ac.Name = name
+	ac.Limits.Conn = 0
+	ac.Limits.LeafNodeConn = 0
+	ac.RevokeAt(jwt.All, time.Now())
+	token, err := op.SignAccount(ac)
+	if err != nil {
+		return fmt.Errorf("failed to sign account JWT: %v", err)
+	}
+	c.logger.Infof("Pushing JWT revoking deleted account %q to cluster %q", name, cl.Name)
+	return pushAccount(c.kclient, c.namespace, op, cl, token)
+}
+
+// syncAccount pushes the account JWT to the servers of the cluster if its
+// claims changed since the last push, and returns the account status.
+func (c *Controller) syncAccount(a *spec.NatsAccount, keys map[string]nkeys.KeyPair) spec.AccountStatus {
+	status := a.Status
+	status.Ready = false
+	if err := a.Validate(); err != nil {
+		status.Reason = fmt.Sprintf("invalid spec: %v", err)
+		return status
+	}
+	kp, ok := keys[a.Name]
+	if !ok {
+		status.Reason = "failed to get account key"
+		return status
+	}
+	status.PublicKey, _ = kp.PublicKey()
+
+	cl, err := k8sutil.GetClusterTPRObject(c.kclient.RESTClient, c.namespace, a.Spec.ClusterName)
+	if err != nil {
+		status.Reason = fmt.Sprintf("failed to get cluster %q: %v", a.Spec.ClusterName, err)
+		return status
+	}
+	if cl.Spec.Accounts == nil {
+		status.Reason = fmt.Sprintf("cluster %q does not have accounts enabled", cl.Name)
+		return status
+	}
+	op, err := EnsureOperator(c.kclient, c.namespace, cl.Name)
+	if err != nil {
+		status.Reason = fmt.Sprintf("failed to load operator: %v", err)
+		return status
+	}
+
+	ac, err := accountClaims(a, status.PublicKey, keys)
+	if err != nil {
+		status.Reason = err.Error()
+		return status
+	}
+	if cl.Spec.Accounts.MemoryResolver() {
+		// the memory resolver is for static accounts: a revocation would
+		// replace every server, and only apply to those replaced so far
+		ac.Revocations = nil
+	}
+	hash := claimsHash(op.PublicKey(), ac)
+	if a.Status.Ready && a.Status.ClaimsHash == hash {
+		status.Ready = true
+		status.Reason = ""
+		return status
+	}
+
+	token, err := op.SignAccount(ac)
+	if err != nil {
+		status.Reason = fmt.Sprintf("failed to sign account JWT: %v", err)
+		return status
+	}
+	if cl.Spec.Accounts.MemoryResolver() {
+		c.logger.Infof("Storing JWT of account %q for cluster %q", a.Name, cl.Name)
+		if err := storeAccount(c.kclient, c.namespace, cl.Name, status.PublicKey, token); err != nil {
+			status.Reason = fmt.Sprintf("failed to store account JWT: %v", err)
+			return status
+		}
+	} else {
+		c.logger.Infof("Pushing JWT of account %q to cluster %q", a.Name, cl.Name)
+		if err := pushAccount(c.kclient, c.namespace, op, cl, token); err != nil {
+			status.Reason = fmt.Sprintf("failed to push account JWT: %v", err)
+			return status
+		}
+	}
+	status.Ready = true
+	status.Reason = ""
+	status.ClaimsHash = hash
+	return status
+}
+
+// syncUser writes the credentials of the user, issued again if the user or
+// its account changed, and returns the user status. Pending users wait for
+// their previous credentials to be revoked.
+func (c *Controller) syncUser(u *spec.NatsUser, a *spec.NatsAccount, keys map[string]nkeys.KeyPair, pending bool) spec.UserStatus {
+	status := u.Status
+	status.Ready = false
+	if err := u.Validate(); err != nil {
+		status.Reason = fmt.Sprintf("invalid spec: %v", err)
+		return status
+	}
+	kp, ok := keys[u.Spec.AccountName]
+	if a == nil || !ok {
+		status.Reason = fmt.Sprintf("account %q not found", u.Spec.AccountName)
+		return status
+	}
+	if pending {
+		status.Reason = errRevocationPending.Error()
+		return status
+	}
+
+	t := c.userTarget(u).credsTarget(a)
+	pub, err := c.issueUser(u.Name, u.Spec.Permissions, kp, t)
+	if len(pub) != 0 {
+		status.PublicKey = pub
+	}
+	if err != nil {
+		status.Reason = err.Error()
+		return status
+	}
+	status.Ready = true
+	status.Reason = ""
+	return status
+}
+
+// issueUser writes the credentials of a user of the account to the target
+// secret, and returns the public key of the user. The credentials are
+// issued again only if the claims of the user changed, and the key of the
+// user is kept. Credentials whose key must change are deleted first.
+func (c *Controller) issueUser(name string, perms *spec.UserPermissions, account nkeys.KeyPair, t credsTarget) (string, error) {
+	secret, err := c.kclient.Secrets(t.namespace).Get(t.secret)
+	if err != nil && !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return "", fmt.Errorf("failed to get credentials secret: %v", err)
+	}
+	exists := err == nil
+	if exists && !t.owns(secret) {
+		return "", fmt.Errorf("secret %s/%s exists and does not belong to %s %q", t.namespace, t.secret, strings.TrimPrefix(t.ownerLabel, "nats_"), t.owner)
+	}
+	var user nkeys.KeyPair
+	if exists {
+		user, _ = nkeys.FromSeed(secret.Data[userSeedKey])
+	}
+	if user == nil {
+		if user, err = nkeys.CreateUser(); err != nil {
+			return "", err
+		}
+	}
+	pub, _ := user.PublicKey()
+
+	accountPub, _ := account.PublicKey()
+	uc := userClaims(name, perms, pub)
+	hash := claimsHash(accountPub, uc)
+	if exists && secret.Annotations[claimsHashAnnotationKey] == hash {
+		return pub, nil
+	}
+
+	c.logger.Infof("Issuing credentials of %s in secret %s/%s", name, t.namespace, t.secret)
+	creds, err := issueCreds(uc, account, user)
+	if err != nil {
+		return pub, fmt.Errorf("failed to issue credentials: %v", err)
+	}
+	seed, _ := user.Seed()
+	annotations := map[string]string{claimsHashAnnotationKey: hash}
+	for k, v := range t.annotations {
+		annotations[k] = v
+	}
+	err = k8sutil.ApplySecret(c.kclient, t.namespace, &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:        t.secret,
+			Labels:      t.labels,
+			Annotations: annotations,
+		},
+		Data: map[string][]byte{
+			credsKey:    creds,
+			userSeedKey: seed,
+		},
+	})
+	if err != nil {
+		return pub, fmt.Errorf("failed to write credentials secret: %v", err)
+	}
+	return pub, nil
+}
+
+// accountClaims returns the claims of the account of a NatsAccount.
+func accountClaims(a *spec.NatsAccount, pub string, keys map[string]nkeys.KeyPair) (*jwt.AccountClaims, error) {
+	ac := jwt.NewAccountClaims(pub)
+	ac.Name = a.Name
+	for _, e := range a.Spec.Exports {
+		ac.Exports.Add(&jwt.Export{
+			Name:    e.Name,
+			Subject: jwt.Subject(e.Subject),
+			Type:    exportType(e.Type),
+		})
+	}
+	for _, i := range a.Spec.Imports {
+		kp, ok := keys[i.Account]
+		if !ok {
+			return nil, fmt.Errorf("imported account %q not found", i.Account)
+		}
+		exporter, _ := kp.PublicKey()
+		ac.Imports.Add(&jwt.Import{
+			Name:         i.Name,
+			Subject:      jwt.Subject(i.Subject),
+			Account:      exporter,
+			LocalSubject: jwt.RenamingSubject(i.LocalSubject),
+			Type:         exportType(i.Type),
+		})
+	}
+	if l := a.Spec.Limits; l != nil {
+		setLimit(&ac.Limits.Conn, l.MaxConnections)
+		setLimit(&ac.Limits.Subs, l.MaxSubscriptions)
+		setLimit(&ac.Limits.Data, l.MaxData)
+		setLimit(&ac.Limits.Payload, l.MaxPayload)
+		setLimit(&ac.Limits.Imports, l.MaxImports)
+		setLimit(&ac.Limits.Exports, l.MaxExports)
+		if js := l.JetStream; js != nil {
+			ac.Limits.JetStreamLimits = jwt.JetStreamLimits{
+				MemoryStorage: quantityLimit(js.MaxMemoryStore),
+				DiskStorage:   quantityLimit(js.MaxFileStore),
+				Streams:       jwt.NoLimit,
+				Consumer:      jwt.NoLimit,
+			}
+			setLimit(&ac.Limits.Streams, js.MaxStreams)
+			setLimit(&ac.Limits.Consumer, js.MaxConsumers)
+		}
+	}
+	for _, r := range a.Status.RevokedUsers {
+		ac.RevokeAt(r.PublicKey, r.Time.Time)
+	}
+	return ac, nil
+}
+
+// userClaims returns the claims of a user with the given permissions.
+func userClaims(name string, perms *spec.UserPermissions, pub string) *jwt.UserClaims {
+	uc := jwt.NewUserClaims(pub)
+	uc.Name = name
+	if perms == nil {
+		return uc
+	}
+	if perms.Publish != nil {
+		uc.Pub.Allow.Add(perms.Publish.Allow...)
+		uc.Pub.Deny.Add(perms.Publish.Deny...)
+	}
+	if perms.Subscribe != nil {
+		uc.Sub.Allow.Add(perms.Subscribe.Allow...)
+		uc.Sub.Deny.Add(perms.Subscribe.Deny...)
+	}
+	return uc
+}
+
+func issueCreds(uc *jwt.UserClaims, account, user nkeys.KeyPair) ([]byte, error) {
+	token, err := uc.Encode(account)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		return nil, err
+	}
+	return jwt.FormatUserConfig(token, seed)
+}
+
+// pushAccount sends the account JWT to the servers of the cluster, which
+// share it among themselves.
+func pushAccount(kclient *kunversioned.Client, ns string, op *Operator, cl *spec.NatsCluster, token string) error {
+	opt, err := op.SystemUser()
+	if err != nil {
+		return err
+	}
+	nc, err := connectCluster(kclient, ns, cl, opt, nats.MaxReconnects(0))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	msg, err := nc.Request(claimsUpdateSubject, []byte(token), claimsPushTimeout)
+	if err != nil {
+		return err
+	}
+	resp := struct {
+		Error *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error,omitempty"`
+	}{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s (%d)", resp.Error.Description, resp.Error.Code)
+	}
+	return nil
+}
+
+// permissionsHash identifies the permissions of a user.
+func permissionsHash(perms *spec.UserPermissions) string {
+	return claimsHash("", perms)
+}
+
+// connectCluster connects the operator to the client port of the cluster,
+// with TLS if the cluster has it.
+func connectCluster(kclient *kunversioned.Client, ns string, cl *spec.NatsCluster, options ...nats.Option) (*nats.Conn, error) {
+	tc, err := k8sutil.ClientTLSConfig(kclient, ns, &cl.Spec)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, nats.Name("nats-operator"))
+	if tc != nil {
+		options = append(options, nats.Secure(tc))
+	}
+	return nats.Connect(k8sutil.ClientURL(cl.Name), options...)
+}
+
+// claimsHash identifies claims before they are signed, along with the key
+// signing them.
+func claimsHash(issuer string, claims interface{}) string {
+	b, _ := json.Marshal(claims)
+	h := sha256.New()
+	h.Write([]byte(issuer))
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func exportType(t string) jwt.ExportType {
+	if t == spec.ExportTypeService {
+		return jwt.Service
+	}
+	return jwt.Stream
+}
+
+func setLimit(limit *int64, v int64) {
+	if v > 0 {
+		*limit = v
+	}
+}
+
+func quantityLimit(q string) int64 {
+	v, err := resource.ParseQuantity(q)
+	if err != nil {
+		return jwt.NoLimit
+	}
+	return v.Value()
+}
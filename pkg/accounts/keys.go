@@ -0,0 +1,113 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	accountSeedKey = "account.seed"
+	// accountUIDAnnotationKey ties the key of an account to its NatsAccount
+	// object, so that an object re-created with the same name gets a new
+	// key.
+	accountUIDAnnotationKey = "nats.io/account-uid"
+)
+
+// ensureAccountKey loads the key of the account of a NatsAccount from its
+// secret, and generates it on first use. The key of a previous object with
+// the same name must be retired first.
+func ensureAccountKey(kclient *unversioned.Client, ns string, a *api.ObjectMeta, clusterName string) (nkeys.KeyPair, error) {
+	secret, err := kclient.Secrets(ns).Get(k8sutil.AccountSecretName(a.Name))
+	if err == nil {
+		switch secret.Annotations[accountUIDAnnotationKey] {
+		case string(a.UID):
+		case "":
+			// made by an older operator, adopted by the object
+			if secret.Annotations == nil {
+				secret.Annotations = map[string]string{}
+			}
+			secret.Annotations[accountUIDAnnotationKey] = string(a.UID)
+			if _, err := kclient.Secrets(ns).Update(secret); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("the key of a previous account %q is not retired yet", a.Name)
+		}
+		return accountKey(secret)
+	}
+	if !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return nil, err
+	}
+
+	kp, err := nkeys.CreateAccount()
+	if err != nil {
+		return nil, err
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return nil, err
+	}
+	secret = &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name: k8sutil.AccountSecretName(a.Name),
+			Labels: map[string]string{
+				"app":          "nats",
+				"nats_cluster": clusterName,
+				"nats_account": a.Name,
+			},
+			Annotations: map[string]string{accountUIDAnnotationKey: string(a.UID)},
+		},
+		Data: map[string][]byte{accountSeedKey: seed},
+	}
+	if _, err := kclient.Secrets(ns).Create(secret); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+func loadAccountKey(kclient *unversioned.Client, ns, accountName string) (nkeys.KeyPair, error) {
+	secret, err := kclient.Secrets(ns).Get(k8sutil.AccountSecretName(accountName))
+	if err != nil {
+		return nil, err
+	}
+	return accountKey(secret)
+}
+
+func accountKey(secret *api.Secret) (nkeys.KeyPair, error) {
+	kp, err := nkeys.FromSeed(secret.Data[accountSeedKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid account seed in secret %q: %v", secret.Name, err)
+	}
+	return kp, nil
+}
+
+// AccountUser returns the option connecting to a cluster as a user of the
+// account of a NatsAccount, for the operator to manage the account's
+// resources, e.g. its JetStream streams.
+func AccountUser(kclient *unversioned.Client, ns, accountName string) (nats.Option, error) {
+	kp, err := loadAccountKey(kclient, ns, accountName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key of account %q: %v", accountName, err)
+	}
+	return internalUser(kp, "nats-operator")
+}
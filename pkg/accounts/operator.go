@@ -0,0 +1,212 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	operatorSeedKey      = "operator.seed"
+	operatorJWTKey       = "operator.jwt"
+	systemAccountSeedKey = "sys.seed"
+	systemAccountJWTKey  = "sys.jwt"
+
+	// internalUserTTL is the lifetime of the user JWTs the operator issues
+	// to connect to a cluster itself.
+	internalUserTTL = 10 * time.Minute
+)
+
+// Operator is the NATS operator identity of a cluster, which signs the
+// account JWTs, along with the system account the servers and the operator
+// exchange account updates in.
+type Operator struct {
+	key              nkeys.KeyPair
+	jwt              string
+	systemAccount    nkeys.KeyPair
+	systemAccountJWT string
+}
+
+// EnsureOperator loads the operator identity of the cluster from its
+// secret, and generates it on first use.
+func EnsureOperator(kclient *unversioned.Client, ns, clusterName string) (*Operator, error) {
+	name := k8sutil.OperatorSecretName(clusterName)
+	secret, err := kclient.Secrets(ns).Get(name)
+	if err == nil {
+		return loadOperator(secret)
+	}
+	if !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return nil, err
+	}
+
+	op, err := newOperator(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	secret, err = op.secret(name, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := kclient.Secrets(ns).Create(secret); err != nil {
+		if !k8sutil.IsKubernetesResourceAlreadyExistError(err) {
+			return nil, err
+		}
+		// generated concurrently, e.g. by the account controller
+		secret, err = kclient.Secrets(ns).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return loadOperator(secret)
+	}
+	return op, nil
+}
+
+func newOperator(clusterName string) (*Operator, error) {
+	op := &Operator{}
+	var err error
+	if op.key, err = nkeys.CreateOperator(); err != nil {
+		return nil, err
+	}
+	if op.systemAccount, err = nkeys.CreateAccount(); err != nil {
+		return nil, err
+	}
+	opPub, _ := op.key.PublicKey()
+	sysPub, _ := op.systemAccount.PublicKey()
+
+	oc := jwt.NewOperatorClaims(opPub)
+	oc.Name = clusterName
+	oc.SystemAccount = sysPub
+	if op.jwt, err = oc.Encode(op.key); err != nil {
+		return nil, err
+	}
+	ac := jwt.NewAccountClaims(sysPub)
+	ac.Name = "SYS"
+	if op.systemAccountJWT, err = ac.Encode(op.key); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func loadOperator(secret *api.Secret) (*Operator, error) {
+	op := &Operator{
+		jwt:              string(secret.Data[operatorJWTKey]),
+		systemAccountJWT: string(secret.Data[systemAccountJWTKey]),
+	}
+	var err error
+	if op.key, err = nkeys.FromSeed(secret.Data[operatorSeedKey]); err != nil {
+		return nil, fmt.Errorf("invalid operator seed in secret %q: %v", secret.Name, err)
+	}
+	if op.systemAccount, err = nkeys.FromSeed(secret.Data[systemAccountSeedKey]); err != nil {
+		return nil, fmt.Errorf("invalid system account seed in secret %q: %v", secret.Name, err)
+	}
+	return op, nil
+}
+
+func (op *Operator) secret(name, clusterName string) (*api.Secret, error) {
+	opSeed, err := op.key.Seed()
+	if err != nil {
+		return nil, err
+	}
+	sysSeed, err := op.systemAccount.Seed()
+	if err != nil {
+		return nil, err
+	}
+	return &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"app":          "nats",
+				"nats_cluster": clusterName,
+			},
+		},
+		Data: map[string][]byte{
+			operatorSeedKey:      opSeed,
+			operatorJWTKey:       []byte(op.jwt),
+			systemAccountSeedKey: sysSeed,
+			systemAccountJWTKey:  []byte(op.systemAccountJWT),
+		},
+	}, nil
+}
+
+// PublicKey returns the public key of the operator.
+func (op *Operator) PublicKey() string {
+	pub, _ := op.key.PublicKey()
+	return pub
+}
+
+// ServerConfig returns the server configuration trusting the operator.
+// The system account is preloaded, since the servers need it to receive
+// the other accounts, along with the given account JWTs, by public key.
+func (op *Operator) ServerConfig(preloads map[string]string) string {
+	sysPub, _ := op.systemAccount.PublicKey()
+	keys := make([]string, 0, len(preloads))
+	for k := range preloads {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "operator: %s\n", op.jwt)
+	fmt.Fprintf(&b, "system_account: %s\n", sysPub)
+	b.WriteString("resolver_preload {\n")
+	fmt.Fprintf(&b, "  %s: %s\n", sysPub, op.systemAccountJWT)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s: %s\n", k, preloads[k])
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// SignAccount issues the account JWT of the claims.
+func (op *Operator) SignAccount(ac *jwt.AccountClaims) (string, error) {
+	return ac.Encode(op.key)
+}
+
+// SystemUser returns the option connecting to the cluster as a system
+// account user, which may push account JWTs.
+func (op *Operator) SystemUser() (nats.Option, error) {
+	return internalUser(op.systemAccount, "nats-operator")
+}
+
+// internalUser issues a short-lived user JWT of an account for the operator
+// to connect with, and returns the option authenticating with it.
+func internalUser(account nkeys.KeyPair, name string) (nats.Option, error) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, err
+	}
+	pub, _ := user.PublicKey()
+	uc := jwt.NewUserClaims(pub)
+	uc.Name = name
+	uc.Expires = time.Now().Add(internalUserTTL).Unix()
+	token, err := uc.Encode(account)
+	if err != nil {
+		return nil, err
+	}
+	return nats.UserJWT(
+		func() (string, error) { return token, nil },
+		func(nonce []byte) ([]byte, error) { return user.Sign(nonce) },
+	), nil
+}
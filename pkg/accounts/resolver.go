@@ -0,0 +1,78 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// ResolverPreloads returns the account JWTs the servers of a cluster with
+// the memory resolver preload, by account public key.
+func ResolverPreloads(kclient *unversioned.Client, ns, clusterName string) (map[string]string, error) {
+	cm, err := kclient.ConfigMaps(ns).Get(k8sutil.AccountsConfigMapName(clusterName))
+	if k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// storeAccount stores the account JWT for the servers of a cluster with the
+// memory resolver to preload, or removes it if the token is empty. The
+// servers are replaced by the cluster to take the change, so the JWT must
+// not carry user revocations.
+func storeAccount(kclient *unversioned.Client, ns, clusterName, pub, token string) error {
+	name := k8sutil.AccountsConfigMapName(clusterName)
+	cm, err := kclient.ConfigMaps(ns).Get(name)
+	if k8sutil.IsKubernetesResourceNotFoundError(err) {
+		if len(token) == 0 {
+			return nil
+		}
+		_, err = kclient.ConfigMaps(ns).Create(&api.ConfigMap{
+			ObjectMeta: api.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"app":          "nats",
+					"nats_cluster": clusterName,
+				},
+			},
+			Data: map[string]string{pub: token},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	if cm.Data[pub] == token {
+		return nil
+	}
+	if len(token) == 0 {
+		delete(cm.Data, pub)
+	} else {
+		cm.Data[pub] = token
+	}
+	// a concurrent update fails on its resource version, and is retried on
+	// the next sync
+	_, err = kclient.ConfigMaps(ns).Update(cm)
+	return err
+}
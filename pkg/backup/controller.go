@@ -0,0 +1,277 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/robfig/cron"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kunversioned "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+var syncInterval = 30 * time.Second
+
+// Controller takes the snapshots of the NatsBackup objects of a namespace
+// when they are due, and deletes the ones beyond their retention.
+//
+// Snapshots are taken by pods copying the NATS Streaming file store of a
+// cluster to an S3-compatible object store with the MinIO client. The store
+// is copied while the streaming server is running, so a snapshot may miss
+// the messages written during the copy.
+type Controller struct {
+	logger *logrus.Entry
+
+	kclient   *kunversioned.Client
+	namespace string
+}
+
+func New(kclient *kunversioned.Client, ns string) *Controller {
+	return &Controller{
+		logger:    logrus.WithField("pkg", "backup"),
+		kclient:   kclient,
+		namespace: ns,
+	}
+}
+
+// Run syncs the backups periodically until stopC is closed.
+func (c *Controller) Run(stopC <-chan struct{}) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			c.sync()
+		}
+	}
+}
+
+func (c *Controller) sync() {
+	list, err := k8sutil.ListBackups(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list backups: %v", err)
+		return
+	}
+	for i := range list.Items {
+		b := &list.Items[i]
+		if err := b.Spec.Validate(); err != nil {
+			c.logger.Errorf("Ignoring invalid backup %q: %v", b.Name, err)
+			continue
+		}
+		if err := c.syncBackup(b, time.Now()); err != nil {
+			c.logger.Errorf("Failed to sync backup %q: %v", b.Name, err)
+		}
+	}
+}
+
+// syncBackup updates the snapshots in progress, takes a new one if due,
+// applies the retention and saves the status of the backup if it changed.
+func (c *Controller) syncBackup(b *spec.NatsBackup, now time.Time) error {
+	old := b.Status.Snapshots
+	b.Status.Snapshots = nil
+	for _, s := range old {
+		if c.syncSnapshot(b, &s) {
+			b.Status.Snapshots = append(b.Status.Snapshots, s)
+		}
+	}
+
+	due, err := snapshotDue(b, now)
+	if err != nil {
+		return err
+	}
+	var startErr error
+	if due {
+		startErr = c.startSnapshot(b, now)
+	}
+	applyRetention(b)
+
+	if reflect.DeepEqual(b.Status.Snapshots, old) {
+		return startErr
+	}
+	if _, err := k8sutil.UpdateBackupTPRObject(c.kclient.RESTClient, c.namespace, b); err != nil {
+		return fmt.Errorf("failed to update status: %v", err)
+	}
+	return startErr
+}
+
+// syncSnapshot updates a snapshot from the pod working on it, and returns
+// false once a snapshot being deleted is gone.
+func (c *Controller) syncSnapshot(b *spec.NatsBackup, s *spec.SnapshotStatus) bool {
+	switch s.Phase {
+	case spec.SnapshotRunning:
+		pod, err := c.kclient.Pods(c.namespace).Get(s.Name)
+		if err != nil {
+			if k8sutil.IsKubernetesResourceNotFoundError(err) {
+				s.Phase = spec.SnapshotFailed
+				s.Message = "backup pod disappeared"
+			} else {
+				c.logger.Warningf("Failed to get backup pod %q: %v", s.Name, err)
+			}
+			return true
+		}
+		switch pod.Status.Phase {
+		case api.PodSucceeded:
+			s.Phase = spec.SnapshotSucceeded
+		case api.PodFailed:
+			s.Phase = spec.SnapshotFailed
+			s.Message = c.podLogs(pod)
+		default:
+			return true
+		}
+		c.logger.Infof("Snapshot %q of backup %q: %s", s.Name, b.Name, s.Phase)
+		c.removePod(pod.Name)
+	case spec.SnapshotDeleting:
+		if err := spec.ValidateSnapshotName(s.Name); err != nil {
+			c.logger.Warningf("Not deleting snapshot of backup %q: %v", b.Name, err)
+			return false
+		}
+		name := s.Name + "-prune"
+		pod, err := c.kclient.Pods(c.namespace).Get(name)
+		if err != nil {
+			if !k8sutil.IsKubernetesResourceNotFoundError(err) {
+				c.logger.Warningf("Failed to get prune pod %q: %v", name, err)
+				return true
+			}
+			if _, err := c.kclient.Pods(c.namespace).Create(k8sutil.MakePruneSnapshotPod(b, s.Name)); err != nil {
+				c.logger.Warningf("Failed to create prune pod %q: %v", name, err)
+			}
+			return true
+		}
+		switch pod.Status.Phase {
+		case api.PodSucceeded:
+			c.logger.Infof("Deleted snapshot %q of backup %q", s.Name, b.Name)
+			c.removePod(name)
+			return false
+		case api.PodFailed:
+			// retried with a new pod on the next sync
+			s.Message = c.podLogs(pod)
+			c.removePod(name)
+		}
+	}
+	return true
+}
+
+// startSnapshot starts a backup pod next to the streaming server of the
+// cluster and records the snapshot as running.
+func (c *Controller) startSnapshot(b *spec.NatsBackup, now time.Time) error {
+	cl, err := k8sutil.GetClusterTPRObject(c.kclient.RESTClient, c.namespace, b.Spec.ClusterName)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster %q: %v", b.Spec.ClusterName, err)
+	}
+	if cl.Spec.Streaming == nil || cl.Spec.Streaming.StoreType != spec.StoreTypeFile || cl.Spec.Storage == nil {
+		return fmt.Errorf("cluster %q has no streaming file store on persistent storage", cl.Name)
+	}
+	podList, err := c.kclient.Pods(c.namespace).List(k8sutil.StreamingPodListOpt(cl.Name))
+	if err != nil {
+		return fmt.Errorf("failed to list NATS Streaming pods: %v", err)
+	}
+	nodeName := ""
+	for i := range podList.Items {
+		if pod := &podList.Items[i]; pod.DeletionTimestamp == nil && api.IsPodReady(pod) {
+			nodeName = pod.Spec.NodeName
+			break
+		}
+	}
+	if len(nodeName) == 0 {
+		return fmt.Errorf("cluster %q has no running NATS Streaming server", cl.Name)
+	}
+
+	s := spec.SnapshotStatus{
+		Name:      fmt.Sprintf("%s-%s", b.Name, now.UTC().Format("20060102150405")),
+		Phase:     spec.SnapshotRunning,
+		StartTime: unversioned.NewTime(now),
+	}
+	c.logger.Infof("Taking snapshot %q of cluster %q", s.Name, cl.Name)
+	if _, err := c.kclient.Pods(c.namespace).Create(k8sutil.MakeBackupPod(b, s.Name, nodeName)); err != nil {
+		s.Phase = spec.SnapshotFailed
+		s.Message = fmt.Sprintf("failed to create backup pod: %v", err)
+	}
+	b.Status.Snapshots = append(b.Status.Snapshots, s)
+	return nil
+}
+
+func (c *Controller) podLogs(pod *api.Pod) string {
+	logs, err := k8sutil.GetPodLogs(c.kclient, c.namespace, pod.Name, "mc", 5)
+	if err != nil {
+		return fmt.Sprintf("failed to get logs: %v", err)
+	}
+	return logs
+}
+
+func (c *Controller) removePod(name string) {
+	if err := c.kclient.Pods(c.namespace).Delete(name, api.NewDeleteOptions(0)); err != nil && !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		c.logger.Warningf("Failed to remove pod %q: %v", name, err)
+	}
+}
+
+// snapshotDue returns true if a snapshot of the backup must be taken now:
+// once for a backup without a schedule, or when the schedule fires after
+// the last snapshot, and never while another one is running.
+func snapshotDue(b *spec.NatsBackup, now time.Time) (bool, error) {
+	snapshots := b.Status.Snapshots
+	for _, s := range snapshots {
+		if s.Phase == spec.SnapshotRunning {
+			return false, nil
+		}
+	}
+	if len(b.Spec.Schedule) == 0 {
+		return len(snapshots) == 0, nil
+	}
+	sched, err := cron.ParseStandard(b.Spec.Schedule)
+	if err != nil {
+		return false, err
+	}
+	last := b.CreationTimestamp.Time
+	if len(snapshots) != 0 {
+		last = snapshots[len(snapshots)-1].StartTime.Time
+	}
+	return !now.Before(sched.Next(last)), nil
+}
+
+// applyRetention marks the successful snapshots beyond the maximum number
+// kept for deletion, oldest first, along with the failed snapshots older
+// than the latest successful one, which may hold partial copies.
+func applyRetention(b *spec.NatsBackup) {
+	snapshots := b.Status.Snapshots
+	keep := b.Spec.MaxSnapshots
+	latest := -1
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := &snapshots[i]
+		switch s.Phase {
+		case spec.SnapshotSucceeded:
+			if latest < 0 {
+				latest = i
+			}
+			if keep > 0 {
+				keep--
+			} else if b.Spec.MaxSnapshots > 0 {
+				s.Phase = spec.SnapshotDeleting
+			}
+		case spec.SnapshotFailed:
+			if latest >= 0 {
+				s.Phase = spec.SnapshotDeleting
+			}
+		}
+	}
+}
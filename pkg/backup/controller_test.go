@@ -0,0 +1,181 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+var created = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func snapshotAt(phase spec.SnapshotPhase, start time.Duration) spec.SnapshotStatus {
+	return spec.SnapshotStatus{Phase: phase, StartTime: unversioned.NewTime(created.Add(start))}
+}
+
+func TestSnapshotDue(t *testing.T) {
+	hourly := "0 * * * *"
+	tests := []struct {
+		name      string
+		schedule  string
+		snapshots []spec.SnapshotStatus
+		now       time.Duration
+		due       bool
+		err       bool
+	}{
+		{
+			name: "unscheduled, not taken",
+			due:  true,
+		},
+		{
+			name:      "unscheduled, taken",
+			snapshots: []spec.SnapshotStatus{snapshotAt(spec.SnapshotSucceeded, 0)},
+			now:       24 * time.Hour,
+		},
+		{
+			name:      "unscheduled, failed",
+			snapshots: []spec.SnapshotStatus{snapshotAt(spec.SnapshotFailed, 0)},
+			now:       24 * time.Hour,
+		},
+		{
+			name:     "scheduled, not fired since creation",
+			schedule: hourly,
+			now:      30 * time.Minute,
+		},
+		{
+			name:     "scheduled, fired since creation",
+			schedule: hourly,
+			now:      time.Hour,
+			due:      true,
+		},
+		{
+			name:      "scheduled, not fired since last snapshot",
+			schedule:  hourly,
+			snapshots: []spec.SnapshotStatus{snapshotAt(spec.SnapshotSucceeded, time.Hour)},
+			now:       90 * time.Minute,
+		},
+		{
+			name:      "scheduled, fired since last snapshot",
+			schedule:  hourly,
+			snapshots: []spec.SnapshotStatus{snapshotAt(spec.SnapshotFailed, time.Hour)},
+			now:       2 * time.Hour,
+			due:       true,
+		},
+		{
+			name:     "snapshot running",
+			schedule: hourly,
+			snapshots: []spec.SnapshotStatus{
+				snapshotAt(spec.SnapshotSucceeded, 0),
+				snapshotAt(spec.SnapshotRunning, time.Hour),
+			},
+			now: 5 * time.Hour,
+		},
+		{
+			name:     "invalid schedule",
+			schedule: "every hour",
+			now:      time.Hour,
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		b := &spec.NatsBackup{}
+		b.CreationTimestamp = unversioned.NewTime(created)
+		b.Spec.Schedule = tt.schedule
+		b.Status.Snapshots = tt.snapshots
+		due, err := snapshotDue(b, created.Add(tt.now))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if due != tt.due {
+			t.Errorf("%s: due = %v, want %v", tt.name, due, tt.due)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	const (
+		ok       = spec.SnapshotSucceeded
+		failed   = spec.SnapshotFailed
+		running  = spec.SnapshotRunning
+		deleting = spec.SnapshotDeleting
+	)
+	tests := []struct {
+		name         string
+		maxSnapshots int
+		phases       []spec.SnapshotPhase
+		want         []spec.SnapshotPhase
+	}{
+		{
+			name:   "all kept",
+			phases: []spec.SnapshotPhase{ok, ok, ok},
+			want:   []spec.SnapshotPhase{ok, ok, ok},
+		},
+		{
+			name:         "oldest beyond maximum deleted",
+			maxSnapshots: 2,
+			phases:       []spec.SnapshotPhase{ok, ok, ok},
+			want:         []spec.SnapshotPhase{deleting, ok, ok},
+		},
+		{
+			name:   "failed before latest success deleted",
+			phases: []spec.SnapshotPhase{failed, ok, failed},
+			want:   []spec.SnapshotPhase{deleting, ok, failed},
+		},
+		{
+			name:   "failed without success kept",
+			phases: []spec.SnapshotPhase{failed, failed},
+			want:   []spec.SnapshotPhase{failed, failed},
+		},
+		{
+			name:         "running not counted",
+			maxSnapshots: 1,
+			phases:       []spec.SnapshotPhase{ok, running},
+			want:         []spec.SnapshotPhase{ok, running},
+		},
+		{
+			name:         "failed and old successes deleted",
+			maxSnapshots: 1,
+			phases:       []spec.SnapshotPhase{ok, failed, ok},
+			want:         []spec.SnapshotPhase{deleting, deleting, ok},
+		},
+		{
+			name:         "already deleting untouched",
+			maxSnapshots: 1,
+			phases:       []spec.SnapshotPhase{deleting, ok},
+			want:         []spec.SnapshotPhase{deleting, ok},
+		},
+	}
+	for _, tt := range tests {
+		b := &spec.NatsBackup{}
+		b.Spec.MaxSnapshots = tt.maxSnapshots
+		for i, phase := range tt.phases {
+			b.Status.Snapshots = append(b.Status.Snapshots, snapshotAt(phase, time.Duration(i)*time.Hour))
+		}
+		applyRetention(b)
+		var got []spec.SnapshotPhase
+		for _, s := range b.Status.Snapshots {
+			got = append(got, s.Phase)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: phases = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// holdForCanary reports whether the rollout must wait for its canaries to
+// be promoted. Canaries which regress while soaking fail the upgrade.
+func (c *Cluster) holdForCanary(members []*api.Pod) bool {
+	if c.spec.Upgrade == nil || c.spec.Upgrade.Canary == nil || c.spec.Upgrade.Canary.Members <= 0 || c.rollingBack() {
+		return false
+	}
+	policy := c.spec.Upgrade.Canary
+	desired := c.desiredSpec()
+	hash := k8sutil.PodTemplateHash(c.name, desired)
+	if c.status.Canary == nil || c.status.Canary.TemplateHash != hash {
+		c.logger.Infof("Starting rollout of pod template %s with %d canaries", hash, policy.Members)
+		c.status.Canary = &spec.CanaryStatus{TemplateHash: hash, Version: desired.Version}
+	}
+	canary := c.status.Canary
+	if canary.Promoted {
+		return false
+	}
+
+	canaries := filterPods(members, func(pod *api.Pod) bool {
+		return k8sutil.GetPodTemplateHash(pod) == hash
+	})
+	if len(canaries) < policy.Members {
+		// upgrade the next canary
+		return false
+	}
+
+	if err := c.checkCanaries(canaries); err != nil {
+		c.failUpgrade(err)
+		return true
+	}
+	if canary.SoakStartTime.IsZero() {
+		canary.SoakStartTime = unversioned.Now()
+	}
+	soaked := time.Since(canary.SoakStartTime.Time) >= time.Duration(policy.SoakSeconds)*time.Second
+	switch {
+	case soaked && !policy.ManualPromotion:
+		c.logger.Infof("Canaries %v soaked, continuing the rollout", k8sutil.GetPodNames(canaries))
+		canary.Promoted = true
+	case soaked && c.canaryPromoted():
+		c.logger.Infof("Canaries %v promoted, continuing the rollout", k8sutil.GetPodNames(canaries))
+		canary.Promoted = true
+	default:
+		c.logger.Infof("Waiting for canaries %v to be promoted", k8sutil.GetPodNames(canaries))
+	}
+	return !canary.Promoted
+}
+
+// checkCanaries returns an error if a canary does not run the expected
+// version or is partitioned from the route mesh.
+func (c *Cluster) checkCanaries(canaries []*api.Pod) error {
+	byName := make(map[string]*spec.MemberStatus, len(c.status.Members))
+	for i := range c.status.Members {
+		byName[c.status.Members[i].Name] = &c.status.Members[i]
+	}
+	for _, pod := range canaries {
+		m, ok := byName[pod.Name]
+		if !ok || len(m.ServerID) == 0 {
+			return fmt.Errorf("canary %q does not answer on its monitoring endpoint", pod.Name)
+		}
+		if !versionMatches(c.status.Canary.Version, m.Version) {
+			return fmt.Errorf("canary %q reports version %q, expected %q", pod.Name, m.Version, c.status.Canary.Version)
+		}
+		if _, partitioned := c.partitionedSince[pod.Name]; partitioned {
+			return fmt.Errorf("canary %q is partitioned from the route mesh", pod.Name)
+		}
+	}
+	return nil
+}
+
+// canaryPromoted reports whether the NatsCluster is annotated to promote
+// the current canaries.
+func (c *Cluster) canaryPromoted() bool {
+	cl, err := k8sutil.GetClusterTPRObject(c.kclient.RESTClient, c.namespace, c.name)
+	if err != nil {
+		c.logger.Warningf("Failed to get cluster to check canary promotion: %v", err)
+		return false
+	}
+	v := cl.Annotations[spec.PromoteCanaryAnnotation]
+	return len(v) != 0 && (v == c.status.Canary.TemplateHash || v == c.status.Canary.Version)
+}
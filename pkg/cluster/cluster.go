@@ -15,18 +15,23 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/fakod/nats-operator/pkg/accounts"
 	"github.com/fakod/nats-operator/pkg/constants"
 	"github.com/fakod/nats-operator/pkg/spec"
 	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
 
 	"github.com/Sirupsen/logrus"
 	k8sapi "k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/util/wait"
 )
 
 type clusterEventType string
@@ -46,9 +51,25 @@ type Cluster struct {
 
 	kclient *unversioned.Client
 
-	status *Status
+	status *spec.ClusterStatus
+	// lastStatus is the status last written to the NatsCluster object.
+	lastStatus       *spec.ClusterStatus
+	lastStatusUpdate time.Time
+
+	// memberRoutes holds the last polled routes of each NATS server, by pod name.
+	memberRoutes map[string]*natsutil.Routez
+	// partitionedSince records when a NATS server was first seen cut off
+	// from the route mesh, by pod name.
+	partitionedSince map[string]time.Time
+	// lastStuckRemoval is when pods stuck pending were last removed.
+	lastStuckRemoval time.Time
+	// joiningSince records when a running pod was first seen out of the
+	// route mesh, by pod name.
+	joiningSince map[string]time.Time
 
 	spec *spec.ClusterSpec
+	// storageClass is the storage class managed by the operator, if any.
+	storageClass string
 
 	name      string
 	namespace string
@@ -58,28 +79,42 @@ type Cluster struct {
 	stopCh    chan struct{}
 }
 
-func New(c *unversioned.Client, name, ns string, spec *spec.ClusterSpec, stopC <-chan struct{}, wg *sync.WaitGroup) *Cluster {
-	return new(c, name, ns, spec, stopC, wg, true)
+// Config holds what a cluster needs from the operator.
+type Config struct {
+	KubeCli   *unversioned.Client
+	Namespace string
+	// StorageClass is the storage class managed by the operator, if any.
+	// Volumes are provisioned from it unless the cluster spec names one.
+	StorageClass string
 }
 
-func Restore(c *unversioned.Client, name, ns string, spec *spec.ClusterSpec, stopC <-chan struct{}, wg *sync.WaitGroup) *Cluster {
-	return new(c, name, ns, spec, stopC, wg, false)
+func New(cfg Config, cl *spec.NatsCluster, stopC <-chan struct{}, wg *sync.WaitGroup) *Cluster {
+	return new(cfg, cl, stopC, wg, true)
 }
 
-func new(kclient *unversioned.Client, name, ns string, spec *spec.ClusterSpec, stopC <-chan struct{}, wg *sync.WaitGroup, isNewCluster bool) *Cluster {
-	if len(spec.Version) == 0 {
+func Restore(cfg Config, cl *spec.NatsCluster, stopC <-chan struct{}, wg *sync.WaitGroup) *Cluster {
+	return new(cfg, cl, stopC, wg, false)
+}
+
+func new(cfg Config, cl *spec.NatsCluster, stopC <-chan struct{}, wg *sync.WaitGroup, isNewCluster bool) *Cluster {
+	cs := cl.Spec
+	if len(cs.Version) == 0 {
 		// TODO: set version in spec in apiserver
-		spec.Version = constants.NatsVersion
+		cs.Version = constants.NatsVersion
 	}
 	c := &Cluster{
-		logger:    logrus.WithField("pkg", "cluster").WithField("cluster-name", name),
-		kclient:   kclient,
-		name:      name,
-		namespace: ns,
+		logger:    logrus.WithField("pkg", "cluster").WithField("cluster-name", cl.Name),
+		kclient:   cfg.KubeCli,
+		name:      cl.Name,
+		namespace: cfg.Namespace,
 		eventCh:   make(chan *clusterEvent, 100),
 		stopCh:    make(chan struct{}),
-		spec:      spec,
-		status:    &Status{},
+		spec:      &cs,
+		status:    cl.Status.Copy(),
+
+		storageClass:     cfg.StorageClass,
+		partitionedSince: map[string]time.Time{},
+		joiningSince:     map[string]time.Time{},
 	}
 	if isNewCluster {
 		err := c.createServices()
@@ -87,6 +122,8 @@ func new(kclient *unversioned.Client, name, ns string, spec *spec.ClusterSpec, s
 			// TODO: do not panic!
 			panic("todo:" + err.Error())
 		}
+	} else if _, err := k8sutil.ApplyMgmtService(c.kclient, c.name, c.namespace); err != nil {
+		c.logger.Warningf("Failed to update management service: %v", err)
 	}
 	wg.Add(1)
 	go c.run(stopC, wg)
@@ -101,6 +138,7 @@ func (c *Cluster) Delete() {
 func (c *Cluster) send(ev *clusterEvent) {
 	select {
 	case c.eventCh <- ev:
+		eventQueueDepth.WithLabelValues(c.name).Set(float64(len(c.eventCh)))
 	case <-c.stopCh:
 	default:
 		panic("TODO: too many events queued...")
@@ -124,11 +162,21 @@ func (c *Cluster) run(stopC <-chan struct{}, wg *sync.WaitGroup) {
 			needDeleteCluster = false
 			return
 		case event := <-c.eventCh:
+			eventQueueDepth.WithLabelValues(c.name).Set(float64(len(c.eventCh)))
 			switch event.typ {
 			case eventModifyCluster:
-				// TODO: we can't handle another upgrade while an upgrade is in progress
+				if err := c.checkUpdate(&event.spec); err != nil {
+					c.logger.Errorf("Rejecting cluster spec update: %v", err)
+					c.status.SetCondition(spec.ClusterConditionSpecRejected, k8sapi.ConditionTrue, "InvalidSpec", err.Error())
+					break
+				}
 				c.logger.Infof("Cluster spec updated from: %+v to: %+v", c.spec, event.spec)
 				c.spec = &event.spec
+				c.resumeUpgrade()
+				if c.status.GetCondition(spec.ClusterConditionSpecRejected) != nil {
+					c.status.SetCondition(spec.ClusterConditionSpecRejected, k8sapi.ConditionFalse, "SpecAccepted",
+						"The last cluster spec update was accepted.")
+				}
 			case eventDeleteCluster:
 				return
 			}
@@ -138,33 +186,46 @@ func (c *Cluster) run(stopC <-chan struct{}, wg *sync.WaitGroup) {
 				continue
 			}
 
-			running, pending, err := c.pollPods()
+			running, pending, failed, err := c.pollPods()
 			if err != nil {
 				c.logger.Errorf("Failed to poll pods: %v", err)
 				continue
 			}
+			c.updateMemberStatus(running)
+			c.checkMesh(running)
+			c.collectFailedPods(failed)
+			pending = c.removeStuckPods(pending)
+			if len(pending) == 0 {
+				c.clearUnschedulable(running)
+			}
+			if err := c.updateStatus(); err != nil {
+				c.logger.Warningf("Failed to update status: %v", err)
+			}
 			if len(pending) > 0 {
 				c.logger.Infof("Skipping reconcilement: running (%v), pending (%v)", k8sutil.GetPodNames(running), k8sutil.GetPodNames(pending))
 				continue
 			}
+			start := time.Now()
 			if err := c.reconcile(running); err != nil {
 				c.logger.Errorf("Failed reconcilement: %v", err)
+				reconcileErrors.WithLabelValues(c.name).Inc()
 			}
+			c.removeUnusedServerConfigs()
+			if err := c.reconcileStreaming(len(running)); err != nil {
+				c.logger.Errorf("Failed streaming reconcilement: %v", err)
+				reconcileErrors.WithLabelValues(c.name).Inc()
+			}
+			reconcileDuration.WithLabelValues(c.name).Observe(time.Since(start).Seconds())
 		}
 	}
 }
 
 func (c *Cluster) Update(spec *spec.ClusterSpec) {
-	anyInterestedChange := false
-	if (spec.Size != c.spec.Size) || (spec.Paused != c.spec.Paused) {
-		anyInterestedChange = true
-	}
 	if len(spec.Version) == 0 {
 		spec.Version = constants.NatsVersion
 	}
-	if spec.Version != c.spec.Version {
-		anyInterestedChange = true
-	}
+	// any change matters, as most of the spec ends up in the pod template
+	anyInterestedChange := !reflect.DeepEqual(spec, c.spec)
 	if anyInterestedChange {
 		c.send(&clusterEvent{
 			typ:  eventModifyCluster,
@@ -173,6 +234,26 @@ func (c *Cluster) Update(spec *spec.ClusterSpec) {
 	}
 }
 
+// checkUpdate returns an error if the spec update is invalid, or changes
+// the version in a way forbidden by the version policy. The version the
+// cluster actually runs is checked against, if known.
+func (c *Cluster) checkUpdate(cs *spec.ClusterSpec) error {
+	if err := cs.Validate(); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(cs.Restore, c.spec.Restore) {
+		return errors.New("restore can only be set when the cluster is created")
+	}
+	from := c.spec.Version
+	if len(c.status.CurrentVersion) != 0 {
+		from = c.status.CurrentVersion
+	}
+	if cs.Version == from {
+		return nil
+	}
+	return cs.VersionPolicy.CheckVersionChange(from, cs.Version)
+}
+
 func (c *Cluster) delete() {
 	c.logger.Infof("Deleting NATS cluster %q...", c.name)
 
@@ -193,21 +274,56 @@ func (c *Cluster) delete() {
 		}
 	}
 
+	pods, err = c.kclient.Pods(c.namespace).List(k8sutil.StreamingPodListOpt(c.name))
+	if err != nil {
+		panic(err)
+	}
+	for i := range pods.Items {
+		if err := c.removePod(pods.Items[i].Name); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := k8sutil.DeleteServerConfigs(c.kclient, c.namespace, c.name, nil); err != nil {
+		panic(err)
+	}
+	if err := c.kclient.ConfigMaps(c.namespace).Delete(k8sutil.AccountsConfigMapName(c.name)); err != nil && !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		panic(err)
+	}
+	if err := k8sutil.DeleteSecret(c.kclient, c.namespace, k8sutil.OperatorSecretName(c.name)); err != nil {
+		panic(err)
+	}
+	if err := k8sutil.DeleteSecret(c.kclient, c.namespace, k8sutil.AuthCalloutSecretName(c.name)); err != nil {
+		panic(err)
+	}
+
+	if err := c.removePod(k8sutil.RestorePodName(c.name)); err != nil && !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		panic(err)
+	}
+
+	if c.spec.Storage == nil || c.spec.Storage.ReclaimPolicy != spec.VolumeReclaimRetain {
+		if err := k8sutil.DeleteClusterPVCs(c.kclient, c.namespace, c.name); err != nil {
+			panic(err)
+		}
+	}
+
 	err = c.deleteServices()
 	if err != nil {
 		// todo: do not panic!
 		panic("todo:" + err.Error())
 	}
 
+	for i := range c.status.Members {
+		deleteMemberMetrics(c.name, &c.status.Members[i])
+	}
+	deleteMetrics(c.name)
 	c.logger.Infof("Successfully deleted NATS cluster %q.", c.name)
 }
 
 func (c *Cluster) createServices() error {
 	// create management service
-	if _, err := k8sutil.CreateMgmtService(c.kclient, c.name, c.namespace); err != nil {
-		if !k8sutil.IsKubernetesResourceAlreadyExistError(err) {
-			return err
-		}
+	if _, err := k8sutil.ApplyMgmtService(c.kclient, c.name, c.namespace); err != nil {
+		return err
 	}
 	// create client service
 	if _, err := k8sutil.CreateService(c.kclient, c.name, c.namespace); err != nil {
@@ -238,9 +354,110 @@ func (c *Cluster) deleteServices() error {
 	return nil
 }
 
-func (c *Cluster) createAndWaitForPod() error {
-	pod := k8sutil.MakePodSpec(c.name, c.spec)
-	return k8sutil.CreateAndWaitPod(c.kclient, c.namespace, pod, 60*time.Second)
+// createAndWaitForPod creates the NATS peer with the given member index,
+// routing to the given peers, and its volume claim if the cluster has
+// persistent storage.
+func (c *Cluster) createAndWaitForPod(index int, routes []string) (*k8sapi.Pod, error) {
+	cs := c.desiredSpec()
+	if cs.Storage != nil {
+		if err := k8sutil.CreatePVC(c.kclient, c.namespace, c.name, k8sutil.MemberPVCName(c.name, index), c.storagePolicy()); err != nil {
+			return nil, err
+		}
+	}
+	authConf := ""
+	var preloads map[string]string
+	if cs.Accounts != nil {
+		op, err := accounts.EnsureOperator(c.kclient, c.namespace, c.name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load operator: %v", err)
+		}
+		if cs.Accounts.MemoryResolver() {
+			if preloads, err = accounts.ResolverPreloads(c.kclient, c.namespace, c.name); err != nil {
+				return nil, fmt.Errorf("failed to get account JWTs: %v", err)
+			}
+		}
+		authConf = op.ServerConfig(preloads)
+	}
+	if err := k8sutil.ApplyServerConfig(c.kclient, c.namespace, c.name, cs, authConf); err != nil {
+		return nil, fmt.Errorf("failed to apply server config: %v", err)
+	}
+	if err := c.waitForMemberName(index); err != nil {
+		return nil, err
+	}
+	pod := k8sutil.MakePodSpec(c.name, index, routes, cs)
+	if cs.Accounts.MemoryResolver() {
+		k8sutil.SetAccountsHash(pod, k8sutil.AccountsHash(preloads))
+	}
+	pod, err := k8sutil.CreateAndWaitPod(c.kclient, c.namespace, pod, c.podCreationTimeout())
+	if err != nil {
+		return nil, err
+	}
+	podsCreated.WithLabelValues(c.name).Inc()
+	return pod, nil
+}
+
+// waitForMemberName makes sure the name of the NATS peer with the given
+// member index is free. A failed peer holding the name is removed, and a
+// peer shutting down is waited for.
+func (c *Cluster) waitForMemberName(index int) error {
+	name := k8sutil.MemberName(c.name, index)
+	return wait.Poll(2*time.Second, c.drainTimeout(), func() (bool, error) {
+		pod, err := c.kclient.Pods(c.namespace).Get(name)
+		if err != nil {
+			if k8sutil.IsKubernetesResourceNotFoundError(err) {
+				return true, nil
+			}
+			return false, err
+		}
+		if pod.Status.Phase == k8sapi.PodFailed && pod.DeletionTimestamp == nil {
+			if err := c.removeFailedPod(pod); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	})
+}
+
+// storagePolicy returns the storage policy of the cluster, with the storage
+// class managed by the operator unless the spec names one.
+func (c *Cluster) storagePolicy() *spec.StoragePolicy {
+	st := *c.spec.Storage
+	if len(st.StorageClass) == 0 {
+		st.StorageClass = c.storageClass
+	}
+	return &st
+}
+
+// freeMemberIndices returns the n lowest member indices not held by a NATS
+// pod, and the routes to the running NATS pods. Failed pods do not hold
+// their index, so that their replacement reattaches their volume.
+func (c *Cluster) freeMemberIndices(n int) ([]int, []string, error) {
+	podList, err := c.kclient.Pods(c.namespace).List(k8sutil.PodListOpt(c.name))
+	if err != nil {
+		return nil, nil, err
+	}
+	used := map[int]bool{}
+	var routes []string
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.Status.Phase == k8sapi.PodFailed {
+			continue
+		}
+		used[k8sutil.GetMemberIndex(pod)] = true
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if r := k8sutil.PodRoute(c.name, pod); len(r) != 0 {
+			routes = append(routes, r)
+		}
+	}
+	var free []int
+	for i := 0; len(free) < n; i++ {
+		if !used[i] {
+			free = append(free, i)
+		}
+	}
+	return free, routes, nil
 }
 
 func (c *Cluster) removePod(name string) error {
@@ -249,31 +466,92 @@ func (c *Cluster) removePod(name string) error {
 		if !k8sutil.IsKubernetesResourceNotFoundError(err) {
 			return err
 		}
+		return nil
 	}
+	podsDeleted.WithLabelValues(c.name).Inc()
 	return nil
 }
 
-func (c *Cluster) pollPods() ([]*k8sapi.Pod, []*k8sapi.Pod, error) {
+// drainAndRemovePod gracefully removes a NATS server. Deleting its pod with
+// a grace period runs the preStop hook, which puts the server in lame duck
+// mode. The pod is then force deleted once its clients migrated to the other
+// peers, or the drain timeout expired.
+func (c *Cluster) drainAndRemovePod(pod *k8sapi.Pod) error {
+	timeout := c.drainTimeout()
+	err := c.kclient.Pods(c.namespace).Delete(pod.Name, k8sapi.NewDeleteOptions(int64(timeout/time.Second)))
+	if err != nil {
+		if !k8sutil.IsKubernetesResourceNotFoundError(err) {
+			return err
+		}
+		return nil
+	}
+	podsDeleted.WithLabelValues(c.name).Inc()
+
+	c.logger.Infof("Draining NATS server %q for up to %v", pod.Name, timeout)
+	err = wait.Poll(2*time.Second, timeout, func() (bool, error) {
+		varz, err := natsutil.GetVarz(pod.Status.PodIP)
+		if err != nil {
+			// the server is gone
+			return true, nil
+		}
+		return varz.Connections == 0, nil
+	})
+	if err != nil {
+		c.logger.Warningf("NATS server %q did not drain within %v", pod.Name, timeout)
+	}
+
+	err = c.kclient.Pods(c.namespace).Delete(pod.Name, k8sapi.NewDeleteOptions(0))
+	if err != nil && !k8sutil.IsKubernetesResourceNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// drainTimeout is how long a NATS server is given to migrate its clients.
+func (c *Cluster) drainTimeout() time.Duration {
+	if c.spec.Pod != nil && c.spec.Pod.DrainTimeoutSeconds > 0 {
+		return time.Duration(c.spec.Pod.DrainTimeoutSeconds) * time.Second
+	}
+	return constants.DefaultDrainTimeoutSeconds * time.Second
+}
+
+func (c *Cluster) pollPods() (running, pending, failed []*k8sapi.Pod, err error) {
 	podList, err := c.kclient.Pods(c.namespace).List(k8sutil.PodListOpt(c.name))
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to list running pods for cluster %q: %+v", c.name, err)
+		return nil, nil, nil, fmt.Errorf("Failed to list running pods for cluster %q: %+v", c.name, err)
 	}
 
-	var running []*k8sapi.Pod
-	var pending []*k8sapi.Pod
 	for i := range podList.Items {
 		pod := &podList.Items[i]
+		if pod.DeletionTimestamp != nil {
+			// being drained or deleted
+			continue
+		}
 		switch pod.Status.Phase {
 		case k8sapi.PodRunning:
 			running = append(running, pod)
 		case k8sapi.PodPending:
 			pending = append(pending, pod)
+		case k8sapi.PodFailed:
+			failed = append(failed, pod)
 		}
 	}
 
-	return running, pending, nil
+	return running, pending, failed, nil
+}
+
+// joinTimeout is how long a running pod may stay out of the route mesh before it is replaced.
+func (c *Cluster) joinTimeout() time.Duration {
+	if c.spec.Pod != nil && c.spec.Pod.JoinTimeoutSeconds > 0 {
+		return time.Duration(c.spec.Pod.JoinTimeoutSeconds) * time.Second
+	}
+	return constants.DefaultJoinTimeoutSeconds * time.Second
 }
 
-func (c *Cluster) upgradeAndWaitForPod(pod *k8sapi.Pod) error {
-	return k8sutil.UpdateAndWaitPod(c.kclient, c.namespace, pod, 60*time.Second)
+// podCreationTimeout is how long to wait for a new or updated pod to become ready.
+func (c *Cluster) podCreationTimeout() time.Duration {
+	if c.spec.Pod != nil && c.spec.Pod.CreationTimeoutSeconds > 0 {
+		return time.Duration(c.spec.Pod.CreationTimeoutSeconds) * time.Second
+	}
+	return constants.DefaultPodCreationTimeoutSeconds * time.Second
 }
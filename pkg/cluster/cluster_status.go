@@ -1,29 +0,0 @@
-// Copyright 2016 The nats-operator Authors
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-//     http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package cluster
-
-type Status struct {
-	CurrentVersion string `json:"currentVersion"`
-	TargetVersion  string `json:"targetVersion"`
-}
-
-func (s *Status) upgradeVersionTo(v string) {
-	s.TargetVersion = v
-}
-
-func (s *Status) setVersion(v string) {
-	s.TargetVersion = ""
-	s.CurrentVersion = v
-}
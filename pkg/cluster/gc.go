@@ -0,0 +1,187 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// failedPodLogLines is the number of log lines of a failed NATS pod
+	// recorded in an event before the pod is deleted.
+	failedPodLogLines = 20
+	// maxEventMessageLength keeps events recording logs reasonably small.
+	maxEventMessageLength = 2048
+)
+
+// collectFailedPods deletes the failed NATS pods beyond the history limit,
+// oldest first, after recording their last logs in an event. NATS pods are
+// never restarted, so every crashed server leaves a failed pod behind, until
+// the server is replaced under the same name.
+func (c *Cluster) collectFailedPods(failed []*api.Pod) {
+	limit := constants.DefaultFailedPodsHistoryLimit
+	if c.spec.Pod != nil && c.spec.Pod.FailedPodsHistoryLimit != nil {
+		limit = *c.spec.Pod.FailedPodsHistoryLimit
+	}
+	if len(failed) <= limit {
+		return
+	}
+
+	sort.Sort(podsByCreation(failed))
+	for _, pod := range failed[:len(failed)-limit] {
+		if err := c.removeFailedPod(pod); err != nil {
+			c.logger.Warningf("Failed to remove failed pod %q: %v", pod.Name, err)
+		}
+	}
+}
+
+// removeFailedPod deletes a failed NATS pod after recording its last logs
+// in an event.
+func (c *Cluster) removeFailedPod(pod *api.Pod) error {
+	logs, err := k8sutil.GetPodLogs(c.kclient, c.namespace, pod.Name, "nats", failedPodLogLines)
+	if err != nil {
+		logs = fmt.Sprintf("failed to get logs: %v", err)
+	}
+	msg := fmt.Sprintf("NATS pod %s failed (%s), last logs:\n%s", pod.Name, podFailureReason(pod), logs)
+	if len(msg) > maxEventMessageLength {
+		msg = msg[:maxEventMessageLength]
+	}
+	if err := k8sutil.CreateClusterEvent(c.kclient, c.namespace, c.name, api.EventTypeWarning, "PodFailed", msg); err != nil {
+		c.logger.Warningf("Failed to record event for failed pod %q: %v", pod.Name, err)
+	}
+
+	c.logger.Infof("Removing failed pod %q", pod.Name)
+	return c.removePod(pod.Name)
+}
+
+// removeStuckPods deletes the pods pending for longer than the pending
+// timeout, reports why they could not start in the Unschedulable condition,
+// and returns the pods which are still pending.
+func (c *Cluster) removeStuckPods(pending []*api.Pod) []*api.Pod {
+	timeout := constants.DefaultPendingTimeoutSeconds * time.Second
+	if c.spec.Pod != nil && c.spec.Pod.PendingTimeoutSeconds > 0 {
+		timeout = time.Duration(c.spec.Pod.PendingTimeoutSeconds) * time.Second
+	}
+
+	var stillPending []*api.Pod
+	var reason string
+	var stuck []string
+	for _, pod := range pending {
+		if time.Since(pod.CreationTimestamp.Time) < timeout {
+			stillPending = append(stillPending, pod)
+			continue
+		}
+		r, msg := pendingReason(pod)
+		c.logger.Warningf("Pod %q has been pending for more than %v (%s: %s), removing it", pod.Name, timeout, r, msg)
+		if err := c.removePod(pod.Name); err != nil {
+			c.logger.Warningf("Failed to remove pending pod %q: %v", pod.Name, err)
+			stillPending = append(stillPending, pod)
+			continue
+		}
+		reason = r
+		stuck = append(stuck, fmt.Sprintf("%s: %s", pod.Name, msg))
+	}
+
+	if len(stuck) > 0 {
+		c.lastStuckRemoval = time.Now()
+		c.status.SetCondition(spec.ClusterConditionUnschedulable, api.ConditionTrue, reason, strings.Join(stuck, "; "))
+	}
+	return stillPending
+}
+
+// clearUnschedulable resets the Unschedulable condition once a pod created
+// after the last stuck pod was removed is running, so that the condition
+// holds while the replacement is still waiting to be scheduled.
+func (c *Cluster) clearUnschedulable(running []*api.Pod) {
+	cond := c.status.GetCondition(spec.ClusterConditionUnschedulable)
+	if cond == nil || cond.Status != api.ConditionTrue {
+		return
+	}
+	since := cond.LastTransitionTime.Time
+	if c.lastStuckRemoval.After(since) {
+		since = c.lastStuckRemoval
+	}
+	for _, pod := range running {
+		if pod.CreationTimestamp.Time.After(since) {
+			c.status.SetCondition(spec.ClusterConditionUnschedulable, api.ConditionFalse, "PodsScheduled", "All NATS pods are scheduled.")
+			return
+		}
+	}
+}
+
+// removeUnusedServerConfigs deletes the config maps of the configurations
+// no NATS pod of the cluster loads anymore, e.g. after a rollout.
+func (c *Cluster) removeUnusedServerConfigs() {
+	podList, err := c.kclient.Pods(c.namespace).List(k8sutil.PodListOpt(c.name))
+	if err != nil {
+		c.logger.Warningf("Failed to list pods: %v", err)
+		return
+	}
+	inUse := map[string]bool{}
+	for i := range podList.Items {
+		if name := k8sutil.GetServerConfigMapName(&podList.Items[i]); len(name) != 0 {
+			inUse[name] = true
+		}
+	}
+	if err := k8sutil.DeleteServerConfigs(c.kclient, c.namespace, c.name, inUse); err != nil {
+		c.logger.Warningf("Failed to remove unused server configs: %v", err)
+	}
+}
+
+// pendingReason returns why a pod is still pending, preferably the reason
+// given by the scheduler.
+func pendingReason(pod *api.Pod) (string, string) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == api.PodScheduled && cond.Status == api.ConditionFalse {
+			return cond.Reason, cond.Message
+		}
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			return w.Reason, w.Message
+		}
+	}
+	return "PendingTimeout", "the pod did not start in time"
+}
+
+// podFailureReason returns why a pod failed.
+func podFailureReason(pod *api.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil {
+			return fmt.Sprintf("%s, exit code %d", t.Reason, t.ExitCode)
+		}
+	}
+	if len(pod.Status.Reason) != 0 {
+		return pod.Status.Reason
+	}
+	return "unknown reason"
+}
+
+type podsByCreation []*api.Pod
+
+func (p podsByCreation) Len() int      { return len(p) }
+func (p podsByCreation) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p podsByCreation) Less(i, j int) bool {
+	return p[i].CreationTimestamp.Before(p[j].CreationTimestamp)
+}
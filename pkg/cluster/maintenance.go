@@ -0,0 +1,52 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// deferDisruption reports whether a disruptive change must wait for the
+// next maintenance window, and records the waiting change in the status.
+func (c *Cluster) deferDisruption(change string) bool {
+	open, next, err := c.spec.MaintenanceWindow.Open(time.Now())
+	if err != nil {
+		// the spec was validated, this should not happen
+		c.logger.Errorf("Invalid maintenance window: %v", err)
+	}
+	if open {
+		return false
+	}
+	c.logger.Infof("Deferring %s to the maintenance window starting at %v", change, next)
+	c.status.SetCondition(spec.ClusterConditionMaintenancePending, api.ConditionTrue, "OutsideMaintenanceWindow",
+		fmt.Sprintf("%s waits for the maintenance window starting at %s", change, next.Format(time.RFC3339)))
+	return true
+}
+
+// clearMaintenancePending resets the MaintenancePending condition, if it
+// was ever set. It is called once the cluster reached its desired state,
+// so that any deferred change was applied.
+func (c *Cluster) clearMaintenancePending() {
+	if c.status.GetCondition(spec.ClusterConditionMaintenancePending) == nil {
+		return
+	}
+	c.status.SetCondition(spec.ClusterConditionMaintenancePending, api.ConditionFalse, "NoPendingChanges",
+		"No disruptive change waits for a maintenance window.")
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// checkMesh verifies, based on the last polled routes, that every NATS
+// server has routes to all the other servers of the cluster, reports the
+// result as the MeshHealthy condition, and keeps track of the servers
+// missing a route to a ready peer. NATS only forwards messages one hop, so
+// a server routed to some peers only is as partitioned as an isolated one.
+func (c *Cluster) checkMesh(pods []*api.Pod) {
+	missing := missingRoutes(c.status.Members, c.memberRoutes, nil)
+	if len(missing) == 0 {
+		c.status.SetCondition(spec.ClusterConditionMeshHealthy, api.ConditionTrue, "FullMesh",
+			"All NATS servers have routes to each other.")
+		meshHealthy.WithLabelValues(c.name).Set(1)
+	} else {
+		var msgs []string
+		for _, name := range sortedKeys(missing) {
+			msgs = append(msgs, fmt.Sprintf("%s misses routes to %v", name, missing[name]))
+		}
+		c.status.SetCondition(spec.ClusterConditionMeshHealthy, api.ConditionFalse, "RoutesMissing",
+			strings.Join(msgs, "; "))
+		meshHealthy.WithLabelValues(c.name).Set(0)
+	}
+
+	ready := map[string]struct{}{}
+	for _, pod := range pods {
+		if api.IsPodReady(pod) {
+			ready[pod.Name] = struct{}{}
+		}
+	}
+	partitioned := missingRoutes(c.status.Members, c.memberRoutes, ready)
+	for name := range c.partitionedSince {
+		if _, ok := partitioned[name]; !ok {
+			delete(c.partitionedSince, name)
+		}
+	}
+	now := time.Now()
+	for name, ids := range partitioned {
+		if _, ok := c.partitionedSince[name]; !ok {
+			c.logger.Warningf("NATS server %q is partitioned from the route mesh, it misses routes to %v", name, ids)
+			c.partitionedSince[name] = now
+		}
+	}
+}
+
+// pickPartitionedPod returns a pod that has been partitioned from the route
+// mesh for longer than the configured timeout, if any. The servers outside
+// the largest group connected through routes go first, so that the larger
+// side of a split is kept, then the ones partitioned for the longest time
+// and missing the most routes.
+func (c *Cluster) pickPartitionedPod(pods []*api.Pod) *api.Pod {
+	timeout := c.spec.MeshPartitionTimeoutSeconds
+	if timeout < 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = constants.DefaultMeshPartitionTimeoutSeconds
+	}
+
+	var overdue []*api.Pod
+	for _, pod := range pods {
+		since, ok := c.partitionedSince[pod.Name]
+		if ok && time.Since(since) >= time.Duration(timeout)*time.Second {
+			overdue = append(overdue, pod)
+		}
+	}
+	if len(overdue) == 0 {
+		return nil
+	}
+
+	cutOff := cutOffMembers(c.status.Members, c.memberRoutes)
+	if outside := filterPods(overdue, func(pod *api.Pod) bool {
+		_, ok := cutOff[pod.Name]
+		return ok
+	}); len(outside) > 0 {
+		overdue = outside
+	}
+	missing := missingRoutes(c.status.Members, c.memberRoutes, nil)
+	var victim *api.Pod
+	for _, pod := range overdue {
+		if victim == nil {
+			victim = pod
+			continue
+		}
+		since, oldest := c.partitionedSince[pod.Name], c.partitionedSince[victim.Name]
+		switch {
+		case since.Before(oldest):
+			victim = pod
+		case since.Equal(oldest) && len(missing[pod.Name]) > len(missing[victim.Name]):
+			victim = pod
+		}
+	}
+	return victim
+}
+
+// reconcileMesh replaces a NATS server that stayed partitioned from the
+// route mesh for too long. The missing member is then recreated by the
+// size reconciliation.
+func (c *Cluster) reconcileMesh(pod *api.Pod) error {
+	c.logger.Warningf("NATS server %q has been partitioned since %v, replacing it", pod.Name, c.partitionedSince[pod.Name])
+	delete(c.partitionedSince, pod.Name)
+	return c.drainAndRemovePod(pod)
+}
+
+// missingRoutes returns, by pod name, the server IDs of the other members
+// each NATS server has no route to. If peers is not nil, only the routes to
+// the members it holds are checked. Members which could not be polled are
+// ignored.
+func missingRoutes(members []spec.MemberStatus, routes map[string]*natsutil.Routez, peers map[string]struct{}) map[string][]string {
+	missing := map[string][]string{}
+	for _, m := range members {
+		r, ok := routes[m.Name]
+		if !ok || len(m.ServerID) == 0 {
+			continue
+		}
+		remotes := map[string]struct{}{}
+		for _, ri := range r.Routes {
+			remotes[ri.RemoteID] = struct{}{}
+		}
+		for _, other := range members {
+			if other.Name == m.Name || len(other.ServerID) == 0 {
+				continue
+			}
+			if _, ok := peers[other.Name]; peers != nil && !ok {
+				continue
+			}
+			if _, ok := remotes[other.ServerID]; !ok {
+				missing[m.Name] = append(missing[m.Name], other.ServerID)
+			}
+		}
+	}
+	return missing
+}
+
+// cutOffMembers returns the names of the members which are not part of the
+// largest group of NATS servers connected through routes. Ties are broken
+// in favor of the group holding the first member by name.
+func cutOffMembers(members []spec.MemberStatus, routes map[string]*natsutil.Routez) map[string]struct{} {
+	byID := map[string]string{}
+	var names []string
+	for _, m := range members {
+		if _, ok := routes[m.Name]; !ok || len(m.ServerID) == 0 {
+			continue
+		}
+		byID[m.ServerID] = m.Name
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+
+	// union-find over the route graph; a route is a connection between two
+	// servers no matter which side reports it.
+	parent := map[string]string{}
+	for _, name := range names {
+		parent[name] = name
+	}
+	var find func(string) string
+	find = func(n string) string {
+		if parent[n] != n {
+			parent[n] = find(parent[n])
+		}
+		return parent[n]
+	}
+	for _, name := range names {
+		for _, ri := range routes[name].Routes {
+			if other, ok := byID[ri.RemoteID]; ok {
+				parent[find(other)] = find(name)
+			}
+		}
+	}
+
+	groups := map[string][]string{}
+	for _, name := range names {
+		root := find(name)
+		groups[root] = append(groups[root], name)
+	}
+	var largest []string
+	for _, name := range names {
+		if g := groups[find(name)]; len(g) > len(largest) {
+			largest = g
+		}
+	}
+
+	cutOff := map[string]struct{}{}
+	inLargest := map[string]struct{}{}
+	for _, name := range largest {
+		inLargest[name] = struct{}{}
+	}
+	for _, name := range names {
+		if _, ok := inLargest[name]; !ok {
+			cutOff[name] = struct{}{}
+		}
+	}
+	return cutOff
+}
+
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
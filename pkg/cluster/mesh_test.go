@@ -0,0 +1,100 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestPickPartitionedPod(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string][]string
+		victim string
+	}{
+		{
+			name: "full mesh",
+			routes: map[string][]string{
+				"a-0": {"a-1", "a-2"},
+				"a-1": {"a-0", "a-2"},
+				"a-2": {"a-0", "a-1"},
+			},
+		},
+		{
+			name: "isolated member",
+			routes: map[string][]string{
+				"a-0": {"a-1"},
+				"a-1": {"a-0"},
+				"a-2": {},
+			},
+			victim: "a-2",
+		},
+		{
+			name: "partly routed member",
+			routes: map[string][]string{
+				"a-0": {"a-1", "a-2", "a-3"},
+				"a-1": {"a-0", "a-2"},
+				"a-2": {"a-0", "a-1"},
+				"a-3": {"a-0"},
+			},
+			victim: "a-3",
+		},
+	}
+	for _, tt := range tests {
+		var pods []testPod
+		for _, name := range []string{"a-0", "a-1", "a-2", "a-3"} {
+			if _, ok := tt.routes[name]; ok {
+				pods = append(pods, testPod{name: name, index: -1, version: "1.0.0"})
+			}
+		}
+		c := &Cluster{
+			logger:           logrus.WithField("test", tt.name),
+			name:             "a",
+			spec:             &spec.ClusterSpec{MeshPartitionTimeoutSeconds: 1},
+			status:           &spec.ClusterStatus{},
+			memberRoutes:     map[string]*natsutil.Routez{},
+			partitionedSince: map[string]time.Time{},
+		}
+		for _, p := range pods {
+			c.status.Members = append(c.status.Members, spec.MemberStatus{Name: p.name, ServerID: "id-" + p.name})
+			r := &natsutil.Routez{}
+			for _, peer := range tt.routes[p.name] {
+				r.Routes = append(r.Routes, natsutil.RouteInfo{RemoteID: "id-" + peer})
+			}
+			r.NumRoutes = len(r.Routes)
+			c.memberRoutes[p.name] = r
+		}
+		running := makeTestPods(pods)
+		c.checkMesh(running)
+		since := time.Now().Add(-time.Minute)
+		for name := range c.partitionedSince {
+			c.partitionedSince[name] = since
+		}
+
+		victim := c.pickPartitionedPod(running)
+		switch {
+		case victim == nil && len(tt.victim) > 0:
+			t.Errorf("%s: got no pod, want %s", tt.name, tt.victim)
+		case victim != nil && victim.Name != tt.victim:
+			t.Errorf("%s: got %s, want %q", tt.name, victim.Name, tt.victim)
+		}
+	}
+}
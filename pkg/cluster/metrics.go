@@ -0,0 +1,147 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "reconcile_duration_seconds",
+		Help:      "Time spent reconciling a NATS cluster.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 120},
+	}, []string{"cluster"})
+
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "reconcile_errors_total",
+		Help:      "Total number of failed reconciliations of a NATS cluster.",
+	}, []string{"cluster"})
+
+	podsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "pods_created_total",
+		Help:      "Total number of NATS pods created by the operator.",
+	}, []string{"cluster"})
+
+	podsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "pods_deleted_total",
+		Help:      "Total number of NATS pods deleted by the operator.",
+	}, []string{"cluster"})
+
+	upgradesInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "upgrade_in_progress",
+		Help:      "Whether a NATS cluster is being upgraded (1) or not (0).",
+	}, []string{"cluster"})
+
+	eventQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "event_queue_depth",
+		Help:      "Number of events waiting to be processed by a NATS cluster.",
+	}, []string{"cluster"})
+
+	meshHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats_operator",
+		Subsystem: "cluster",
+		Name:      "mesh_healthy",
+		Help:      "Whether all NATS servers of a cluster have routes to each other (1) or not (0).",
+	}, []string{"cluster"})
+
+	memberInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats_operator",
+		Subsystem: "member",
+		Name:      "info",
+		Help:      "Server ID and version reported by a NATS server, always 1.",
+	}, []string{"cluster", "pod", "server_id", "version"})
+
+	memberConnections   = newMemberGaugeVec("connections", "Number of client connections of a NATS server.")
+	memberRoutes        = newMemberGaugeVec("routes", "Number of routes of a NATS server.")
+	memberInMsgs        = newMemberGaugeVec("in_msgs", "Number of messages received by a NATS server.")
+	memberOutMsgs       = newMemberGaugeVec("out_msgs", "Number of messages sent by a NATS server.")
+	memberInBytes       = newMemberGaugeVec("in_bytes", "Number of bytes received by a NATS server.")
+	memberOutBytes      = newMemberGaugeVec("out_bytes", "Number of bytes sent by a NATS server.")
+	memberSlowConsumers = newMemberGaugeVec("slow_consumers", "Number of slow consumers detected by a NATS server.")
+	memberUptime        = newMemberGaugeVec("uptime_seconds", "Time since a NATS server started.")
+	memberJSMemory      = newMemberGaugeVec("jetstream_memory_bytes", "Memory used by the JetStream memory streams of a NATS server.")
+	memberJSStorage     = newMemberGaugeVec("jetstream_storage_bytes", "Disk space used by the JetStream file streams of a NATS server.")
+)
+
+// memberGaugeVecs are the per NATS server metrics labeled by cluster and pod.
+var memberGaugeVecs = []*prometheus.GaugeVec{
+	memberConnections,
+	memberRoutes,
+	memberInMsgs,
+	memberOutMsgs,
+	memberInBytes,
+	memberOutBytes,
+	memberSlowConsumers,
+	memberUptime,
+	memberJSMemory,
+	memberJSStorage,
+}
+
+func newMemberGaugeVec(name, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats_operator",
+		Subsystem: "member",
+		Name:      name,
+		Help:      help,
+	}, []string{"cluster", "pod"})
+}
+
+func init() {
+	prometheus.MustRegister(reconcileDuration)
+	prometheus.MustRegister(reconcileErrors)
+	prometheus.MustRegister(podsCreated)
+	prometheus.MustRegister(podsDeleted)
+	prometheus.MustRegister(upgradesInProgress)
+	prometheus.MustRegister(eventQueueDepth)
+	prometheus.MustRegister(meshHealthy)
+	prometheus.MustRegister(memberInfo)
+	for _, v := range memberGaugeVecs {
+		prometheus.MustRegister(v)
+	}
+}
+
+// deleteMetrics removes all the series labeled with the given cluster name.
+func deleteMetrics(clusterName string) {
+	reconcileDuration.DeleteLabelValues(clusterName)
+	reconcileErrors.DeleteLabelValues(clusterName)
+	podsCreated.DeleteLabelValues(clusterName)
+	podsDeleted.DeleteLabelValues(clusterName)
+	upgradesInProgress.DeleteLabelValues(clusterName)
+	eventQueueDepth.DeleteLabelValues(clusterName)
+	meshHealthy.DeleteLabelValues(clusterName)
+}
+
+// deleteMemberMetrics removes all the series of a NATS server.
+func deleteMemberMetrics(clusterName string, m *spec.MemberStatus) {
+	memberInfo.DeleteLabelValues(clusterName, m.Name, m.ServerID, m.Version)
+	for _, v := range memberGaugeVecs {
+		v.DeleteLabelValues(clusterName, m.Name)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// statusUpdateInterval bounds how often member statistics, which change
+// on every poll, are written back to the NatsCluster object.
+const statusUpdateInterval = 30 * time.Second
+
+// updateMemberStatus polls the monitoring endpoint of every running NATS
+// server and records what they report in the cluster status and metrics.
+func (c *Cluster) updateMemberStatus(pods []*api.Pod) {
+	members := make([]spec.MemberStatus, len(pods))
+	routes := make([]*natsutil.Routez, len(pods))
+	var wg sync.WaitGroup
+	for i := range pods {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, r, err := c.pollMember(pods[i])
+			if err != nil {
+				c.logger.Warningf("Failed to poll monitoring endpoint of pod %q: %v", pods[i].Name, err)
+			}
+			members[i] = *m
+			routes[i] = r
+		}(i)
+	}
+	wg.Wait()
+
+	c.memberRoutes = make(map[string]*natsutil.Routez, len(pods))
+	for i := range pods {
+		if routes[i] != nil {
+			c.memberRoutes[pods[i].Name] = routes[i]
+		}
+	}
+
+	current := make(map[string]*spec.MemberStatus, len(members))
+	for i := range members {
+		current[members[i].Name] = &members[i]
+	}
+	for i := range c.status.Members {
+		old := &c.status.Members[i]
+		m, ok := current[old.Name]
+		if !ok {
+			deleteMemberMetrics(c.name, old)
+		} else if m.ServerID != old.ServerID || m.Version != old.Version {
+			memberInfo.DeleteLabelValues(c.name, old.Name, old.ServerID, old.Version)
+		}
+	}
+	c.status.Members = members
+}
+
+// pollMember retrieves the state and routes of the NATS server running in
+// pod. The returned member status is never nil, even if polling failed.
+func (c *Cluster) pollMember(pod *api.Pod) (*spec.MemberStatus, *natsutil.Routez, error) {
+	m := &spec.MemberStatus{Name: pod.Name}
+	host := pod.Status.PodIP
+
+	varz, err := natsutil.GetVarz(host)
+	if err != nil {
+		return m, nil, err
+	}
+	routez, err := natsutil.GetRoutez(host)
+	if err != nil {
+		return m, nil, err
+	}
+	connz, err := natsutil.GetConnz(host)
+	if err != nil {
+		return m, nil, err
+	}
+
+	// A failing JetStream endpoint leaves the usage unset but must not
+	// discard the route data the mesh checks rely on.
+	var jsz *natsutil.Jsz
+	if c.spec.JetStream != nil {
+		if jsz, err = natsutil.GetJsz(host); err != nil {
+			c.logger.Warningf("Failed to get JetStream usage of pod %q: %v", pod.Name, err)
+			memberJSMemory.DeleteLabelValues(c.name, m.Name)
+			memberJSStorage.DeleteLabelValues(c.name, m.Name)
+		}
+	}
+
+	m.ServerID = varz.ID
+	m.Version = varz.Version
+	m.Connections = connz.NumConns
+	m.Routes = routez.NumRoutes
+	m.InMsgs = varz.InMsgs
+	m.OutMsgs = varz.OutMsgs
+	m.InBytes = varz.InBytes
+	m.OutBytes = varz.OutBytes
+	m.SlowConsumers = varz.SlowConsumers
+	m.Uptime = varz.Uptime
+	if jsz != nil {
+		m.JetStream = &spec.JetStreamUsage{
+			Memory:    jsz.Memory,
+			Storage:   jsz.Storage,
+			Streams:   jsz.Streams,
+			Consumers: jsz.Consumers,
+			Messages:  jsz.Messages,
+			Bytes:     jsz.Bytes,
+		}
+		memberJSMemory.WithLabelValues(c.name, m.Name).Set(float64(jsz.Memory))
+		memberJSStorage.WithLabelValues(c.name, m.Name).Set(float64(jsz.Storage))
+	}
+
+	memberInfo.WithLabelValues(c.name, m.Name, m.ServerID, m.Version).Set(1)
+	memberConnections.WithLabelValues(c.name, m.Name).Set(float64(m.Connections))
+	memberRoutes.WithLabelValues(c.name, m.Name).Set(float64(m.Routes))
+	memberInMsgs.WithLabelValues(c.name, m.Name).Set(float64(m.InMsgs))
+	memberOutMsgs.WithLabelValues(c.name, m.Name).Set(float64(m.OutMsgs))
+	memberInBytes.WithLabelValues(c.name, m.Name).Set(float64(m.InBytes))
+	memberOutBytes.WithLabelValues(c.name, m.Name).Set(float64(m.OutBytes))
+	memberSlowConsumers.WithLabelValues(c.name, m.Name).Set(float64(m.SlowConsumers))
+	if !varz.Start.IsZero() {
+		memberUptime.WithLabelValues(c.name, m.Name).Set(time.Since(varz.Start).Seconds())
+	}
+	return m, routez, nil
+}
+
+// updateStatus writes the cluster status back to the NatsCluster object
+// if it changed since the last update.
+func (c *Cluster) updateStatus() error {
+	if !c.statusChanged() {
+		return nil
+	}
+
+	cl, err := k8sutil.GetClusterTPRObject(c.kclient.RESTClient, c.namespace, c.name)
+	if err != nil {
+		return err
+	}
+	cl.Status = *c.status.Copy()
+	if _, err := k8sutil.UpdateClusterTPRObject(c.kclient.RESTClient, c.namespace, cl); err != nil {
+		return err
+	}
+
+	c.lastStatus = c.status.Copy()
+	c.lastStatusUpdate = time.Now()
+	return nil
+}
+
+// statusChanged reports whether the status needs to be written back.
+// Member statistics alone only trigger a write every statusUpdateInterval.
+func (c *Cluster) statusChanged() bool {
+	if c.lastStatus == nil {
+		return true
+	}
+	if time.Since(c.lastStatusUpdate) >= statusUpdateInterval {
+		return !reflect.DeepEqual(c.status, c.lastStatus)
+	}
+	cur, last := *c.status, *c.lastStatus
+	cur.Members, last.Members = nil, nil
+	return !reflect.DeepEqual(cur, last)
+}
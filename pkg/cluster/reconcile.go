@@ -15,25 +15,68 @@
 package cluster
 
 import (
-	"github.com/fakod/nats-operator/pkg/spec"
+	"fmt"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/accounts"
 	"github.com/fakod/nats-operator/pkg/util/k8sutil"
 
 	"k8s.io/kubernetes/pkg/api"
 )
 
 // reconcile reconciles cluster current state to desired state specified by spec.
+// - if a peer stayed partitioned from the route mesh for too long, it replaces it.
+// - if the cluster is too large, it removes peers, not ready ones first.
+// - it waits for peers to join the cluster, and replaces those not joining in time.
 // - it tries to reconcile the cluster to desired size.
-// - if the cluster needs upgrade, it tries to upgrade existing peers, one by one.
+// - if the cluster needs upgrade, it replaces existing peers, one by one.
+// - if an upgrade failed, it holds the rollout until the spec is updated.
+// - if the upgrade has canaries, it holds the rollout until they are promoted.
+// - with the memory account resolver, it replaces the peers preloading outdated account JWTs, one by one.
+// - upgrades and scale downs of ready peers wait for the maintenance window.
 func (c *Cluster) reconcile(pods []*api.Pod) error {
 	c.logger.Debugln("Start reconciling...")
 	var err error
 
+	upgradesInProgress.WithLabelValues(c.name).Set(0)
+	partitioned := c.pickPartitionedPod(pods)
+	members, joining := c.splitJoining(pods)
+	c.trackJoining(joining)
+	outdated := c.pickPodToUpgrade(members)
+	stale := c.pickPodWithStaleAccounts(members)
 	switch {
-	case len(pods) != c.spec.Size:
+	case partitioned != nil:
+		err = c.reconcileMesh(partitioned)
+	case len(pods) > c.spec.Size:
 		err = c.reconcileSize(pods)
-	case needsUpgrade(pods, c.spec):
-		c.status.upgradeVersionTo(c.spec.Version)
-		err = c.reconcileUpgrade(pods, c.spec)
+	case len(joining) > 0:
+		err = c.reconcileJoining(members, joining)
+	case len(members) < c.spec.Size && c.upgradePaused():
+		// a peer replaced in place failed its health check, recreating
+		// it from the desired spec would carry on the rollout
+		c.logger.Warningf("Upgrade failed, missing members are recreated once the cluster spec is updated")
+	case len(members) != c.spec.Size:
+		err = c.reconcileSize(members)
+	case outdated != nil && c.upgradePaused():
+		c.logger.Warningf("Upgrade failed, rollout paused until the cluster spec is updated")
+	case outdated != nil && c.holdForCanary(members):
+		upgradesInProgress.WithLabelValues(c.name).Set(1)
+	case outdated != nil && c.deferDisruption(fmt.Sprintf("Upgrade of pod %s", outdated.Name)):
+	case outdated != nil:
+		upgradesInProgress.WithLabelValues(c.name).Set(1)
+		if !c.rollingBack() && k8sutil.GetNATSVersion(outdated) != c.spec.Version {
+			c.status.UpgradeVersionTo(c.spec.Version)
+		}
+		err = c.reconcileUpgrade(members, outdated)
+	case stale != nil && c.upgradePaused():
+		c.logger.Warningf("Upgrade failed, account updates paused until the cluster spec is updated")
+	case stale != nil && c.deferDisruption(fmt.Sprintf("Account update of pod %s", stale.Name)):
+	case stale != nil:
+		err = c.reconcileUpgrade(members, stale)
+	default:
+		c.status.SetVersion(c.desiredSpec().Version)
+		c.status.Canary = nil
+		c.clearMaintenancePending()
 	}
 
 	c.logger.Debugln("Finished reconciling.")
@@ -45,11 +88,15 @@ func (c *Cluster) reconcileSize(pods []*api.Pod) error {
 	c.logger.Warningf("Cluster size needs reconciling: expected %d, has %d", c.spec.Size, len(pods))
 	// do we need to add or remove pods?
 	if len(pods) < c.spec.Size {
-		if err := c.createAndWaitForPod(); err != nil {
+		if err := c.scaleUp(c.spec.Size - len(pods)); err != nil {
 			return err
 		}
 	} else if len(pods) > c.spec.Size {
-		if err := c.removePod(pods[len(pods)-1].Name); err != nil {
+		victim := c.pickPodToRemove(pods)
+		if api.IsPodReady(victim) && c.deferDisruption(fmt.Sprintf("Scale down from %d to %d members", len(pods), c.spec.Size)) {
+			return nil
+		}
+		if err := c.drainAndRemovePod(victim); err != nil {
 			c.logger.Error(err)
 		}
 	}
@@ -57,23 +104,130 @@ func (c *Cluster) reconcileSize(pods []*api.Pod) error {
 	return nil
 }
 
-func (c *Cluster) reconcileUpgrade(pods []*api.Pod, cs *spec.ClusterSpec) error {
-	c.logger.Warningf("Cluster version doesn't match, reconciling...")
-	pod := pickPodToUpgrade(pods, cs.Version)
-	k8sutil.SetNATSVersion(pod, cs.Version)
-	return c.upgradeAndWaitForPod(pod)
+// trackJoining records when each joining pod was first seen joining, and
+// forgets the pods which joined or are gone.
+func (c *Cluster) trackJoining(joining []*api.Pod) {
+	now := time.Now()
+	current := map[string]struct{}{}
+	for _, pod := range joining {
+		current[pod.Name] = struct{}{}
+		if _, ok := c.joiningSince[pod.Name]; !ok {
+			c.joiningSince[pod.Name] = now
+		}
+	}
+	for name := range c.joiningSince {
+		if _, ok := current[name]; !ok {
+			delete(c.joiningSince, name)
+		}
+	}
+}
+
+// reconcileJoining waits for the peers which are not members yet to join
+// the cluster. A peer which did not join within the join timeout is
+// replaced, the missing member is then recreated by the size reconciliation.
+func (c *Cluster) reconcileJoining(members, joining []*api.Pod) error {
+	timeout := c.joinTimeout()
+	for _, pod := range joining {
+		since := c.joiningSince[pod.Name]
+		if time.Since(since) < timeout {
+			continue
+		}
+		c.logger.Warningf("Pod %q has been joining since %v, replacing it", pod.Name, since)
+		delete(c.joiningSince, pod.Name)
+		return c.drainAndRemovePod(pod)
+	}
+	c.logger.Infof("Waiting for peers to join: members (%v), joining (%v)", k8sutil.GetPodNames(members), k8sutil.GetPodNames(joining))
+	return nil
+}
+
+// reconcileUpgrade replaces a peer made from an outdated pod template.
+// A peer with a volume is drained and removed first, so that the new one
+// takes over its identity and volume. Otherwise, the new peer is created
+// first with a free identity, so the cluster keeps its capacity, and the
+// old one removed once the new one is healthy. A new peer failing its
+// health check is removed and the rollout paused.
+func (c *Cluster) reconcileUpgrade(members []*api.Pod, old *api.Pod) error {
+	c.logger.Warningf("Pod %q is outdated, replacing it", old.Name)
+	index := k8sutil.GetMemberIndex(old)
+	inPlace := index >= 0 && c.spec.Storage != nil
+	peers := len(members)
+	if inPlace {
+		if err := c.drainAndRemovePod(old); err != nil {
+			return err
+		}
+		peers--
+	}
+	free, routes, err := c.freeMemberIndices(1)
+	if err != nil {
+		return err
+	}
+	if !inPlace {
+		index = free[0]
+	}
+
+	pod, err := c.createAndWaitForPod(index, routes)
+	if err != nil {
+		c.failUpgrade(fmt.Errorf("new peer did not become ready: %v", err))
+		return err
+	}
+	if err := c.waitForHealthyMember(pod, c.desiredSpec().Version, peers); err != nil {
+		c.failUpgrade(err)
+		if err := c.removePod(pod.Name); err != nil {
+			c.logger.Warningf("Failed to remove unhealthy pod %q: %v", pod.Name, err)
+		}
+		return err
+	}
+	if inPlace {
+		return nil
+	}
+	return c.drainAndRemovePod(old)
+}
+
+// pickPodWithStaleAccounts selects the first pod, if any, whose server
+// preloaded other account JWTs than the current ones, with the memory
+// account resolver.
+func (c *Cluster) pickPodWithStaleAccounts(pods []*api.Pod) *api.Pod {
+	if !c.spec.Accounts.MemoryResolver() {
+		return nil
+	}
+	preloads, err := accounts.ResolverPreloads(c.kclient, c.namespace, c.name)
+	if err != nil {
+		c.logger.Warningf("Failed to get account JWTs: %v", err)
+		return nil
+	}
+	hash := k8sutil.AccountsHash(preloads)
+	for _, pod := range pods {
+		if k8sutil.GetAccountsHash(pod) != hash {
+			return pod
+		}
+	}
+	return nil
 }
 
-// needsUpgrade determines whether cluster needs upgrade or not.
-func needsUpgrade(pods []*api.Pod, cs *spec.ClusterSpec) bool {
-	return len(pods) == cs.Size && pickPodToUpgrade(pods, cs.Version) != nil
+// splitJoining separates the running pods which are members of the cluster
+// from the ones which are not ready yet, or ready but known to have no
+// routes to the other peers.
+func (c *Cluster) splitJoining(pods []*api.Pod) (members, joining []*api.Pod) {
+	for _, pod := range pods {
+		r, polled := c.memberRoutes[pod.Name]
+		switch {
+		case !api.IsPodReady(pod):
+			joining = append(joining, pod)
+		case polled && r.NumRoutes == 0 && len(c.memberRoutes) > 1:
+			joining = append(joining, pod)
+		default:
+			members = append(members, pod)
+		}
+	}
+	return members, joining
 }
 
-// pickExistingPeer selects the first pod, if any, which version doesn't
-// correspond to desired version.
-func pickPodToUpgrade(pods []*api.Pod, newVersion string) *api.Pod {
+// pickPodToUpgrade selects the first pod, if any, which was made from
+// another pod template than the one derived from the desired spec.
+func (c *Cluster) pickPodToUpgrade(pods []*api.Pod) *api.Pod {
+	hash := k8sutil.PodTemplateHash(c.name, c.desiredSpec())
 	for _, pod := range pods {
-		if k8sutil.GetNATSVersion(pod) != newVersion {
+		if k8sutil.GetPodTemplateHash(pod) != hash {
 			return pod
 		}
 	}
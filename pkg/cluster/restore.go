@@ -0,0 +1,100 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// restoreStreamingStore seeds the NATS Streaming file store of a cluster
+// with a restore policy from a snapshot, before the streaming server first
+// starts. It returns true once the store is restored, and false while the
+// restore pod is running. A failed restore is retried with a new pod. The
+// restored snapshot is recorded in the status before the restore pod is
+// removed, so that a restored store is never restored again.
+func (c *Cluster) restoreStreamingStore() (bool, error) {
+	if c.spec.Restore == nil || len(c.status.RestoredSnapshot) != 0 {
+		return true, nil
+	}
+
+	name := k8sutil.RestorePodName(c.name)
+	pod, err := c.kclient.Pods(c.namespace).Get(name)
+	if err != nil {
+		if !k8sutil.IsKubernetesResourceNotFoundError(err) {
+			return false, err
+		}
+		return false, c.startRestore()
+	}
+
+	switch pod.Status.Phase {
+	case api.PodSucceeded:
+		snapshot := k8sutil.GetRestoredSnapshot(pod)
+		c.logger.Infof("Restored NATS Streaming store from snapshot %q", snapshot)
+		c.status.RestoredSnapshot = snapshot
+		if err := c.updateStatus(); err != nil {
+			c.status.RestoredSnapshot = ""
+			return false, fmt.Errorf("failed to record restored snapshot %q: %v", snapshot, err)
+		}
+		if err := c.removePod(name); err != nil {
+			c.logger.Warningf("Failed to remove restore pod %q: %v", name, err)
+		}
+		return true, nil
+	case api.PodFailed:
+		logs, err := k8sutil.GetPodLogs(c.kclient, c.namespace, name, "mc", failedPodLogLines)
+		if err != nil {
+			logs = fmt.Sprintf("failed to get logs: %v", err)
+		}
+		if err := c.removePod(name); err != nil {
+			c.logger.Warningf("Failed to remove restore pod %q: %v", name, err)
+		}
+		return false, fmt.Errorf("restore of snapshot %q failed: %s", k8sutil.GetRestoredSnapshot(pod), logs)
+	}
+	return false, nil
+}
+
+// startRestore creates the pod copying the snapshot of the restore policy,
+// by default the latest successful one of the backup, into the store.
+func (c *Cluster) startRestore() error {
+	rp := c.spec.Restore
+	backup, err := k8sutil.GetBackupTPRObject(c.kclient.RESTClient, c.namespace, rp.BackupName)
+	if err != nil {
+		return fmt.Errorf("failed to get backup %q: %v", rp.BackupName, err)
+	}
+	if err := backup.Spec.Validate(); err != nil {
+		return fmt.Errorf("invalid backup %q: %v", rp.BackupName, err)
+	}
+	snapshot := rp.Snapshot
+	if len(snapshot) == 0 {
+		latest := backup.Status.LatestSnapshot()
+		if latest == nil {
+			return fmt.Errorf("backup %q has no successful snapshot", rp.BackupName)
+		}
+		snapshot = latest.Name
+	}
+	if err := spec.ValidateSnapshotName(snapshot); err != nil {
+		return err
+	}
+
+	c.logger.Infof("Restoring NATS Streaming store from snapshot %q of backup %q", snapshot, rp.BackupName)
+	if _, err := c.kclient.Pods(c.namespace).Create(k8sutil.MakeRestorePod(c.name, &backup.Spec, snapshot)); err != nil {
+		return fmt.Errorf("failed to create restore pod: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// scaleUp creates up to missing NATS pods, at most a batch of them,
+// concurrently, and waits for all of them to become ready. The new peers
+// route to the running ones and to each other.
+func (c *Cluster) scaleUp(missing int) error {
+	n := c.spec.ScaleUpBatchSize
+	if n <= 0 {
+		n = 1
+	}
+	if missing < n {
+		n = missing
+	}
+
+	indices, routes, err := c.freeMemberIndices(n)
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, n)
+	for _, index := range indices {
+		peers := routes
+		for _, other := range indices {
+			if other != index {
+				peers = append(peers[:len(peers):len(peers)], k8sutil.MemberRoute(c.name, other))
+			}
+		}
+		go func(index int, peers []string) {
+			_, err := c.createAndWaitForPod(index, peers)
+			errCh <- err
+		}(index, peers)
+	}
+	var errs []string
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to create %d of %d pods: %s", len(errs), n, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pickPodToRemove selects the NATS server to remove when scaling down.
+// Pods which did not join the cluster go first, e.g. a surplus peer of an
+// upgrade which never got routes, then pods not running the expected
+// version. The remaining candidates are chosen by the scale down policy,
+// and ties go to the pod with the highest member index.
+func (c *Cluster) pickPodToRemove(pods []*api.Pod) *api.Pod {
+	candidates := pods
+	_, joining := c.splitJoining(pods)
+	outdated := filterPods(pods, func(pod *api.Pod) bool {
+		return k8sutil.GetNATSVersion(pod) != c.spec.Version
+	})
+	switch {
+	case len(joining) > 0:
+		candidates = joining
+	case len(outdated) > 0:
+		candidates = outdated
+	}
+
+	if c.spec.ScaleDownPolicy == spec.ScaleDownSpread {
+		candidates = c.mostCrowded(candidates, pods)
+	}
+	return c.fewestConnections(candidates)
+}
+
+// memberRank orders pods by member index. Pods made before members had
+// identities rank above all members, so they are removed first on ties.
+func memberRank(pod *api.Pod) int {
+	if i := k8sutil.GetMemberIndex(pod); i >= 0 {
+		return i
+	}
+	return math.MaxInt32
+}
+
+// mostCrowded returns the candidates in the zone, then on the node, hosting
+// the most pods of the cluster.
+func (c *Cluster) mostCrowded(candidates, pods []*api.Pod) []*api.Pod {
+	zones := map[string]string{}
+	zoneOf := func(nodeName string) string {
+		if z, ok := zones[nodeName]; ok {
+			return z
+		}
+		node, err := c.kclient.Nodes().Get(nodeName)
+		if err != nil {
+			c.logger.Warningf("Failed to get node %q: %v", nodeName, err)
+			zones[nodeName] = ""
+			return ""
+		}
+		zones[nodeName] = node.Labels[unversioned.LabelZoneFailureDomain]
+		return zones[nodeName]
+	}
+
+	perZone := map[string]int{}
+	perNode := map[string]int{}
+	for _, pod := range pods {
+		perZone[zoneOf(pod.Spec.NodeName)]++
+		perNode[pod.Spec.NodeName]++
+	}
+
+	maxZone := 0
+	for _, pod := range candidates {
+		if n := perZone[zoneOf(pod.Spec.NodeName)]; n > maxZone {
+			maxZone = n
+		}
+	}
+	candidates = filterPods(candidates, func(pod *api.Pod) bool {
+		return perZone[zoneOf(pod.Spec.NodeName)] == maxZone
+	})
+
+	maxNode := 0
+	for _, pod := range candidates {
+		if n := perNode[pod.Spec.NodeName]; n > maxNode {
+			maxNode = n
+		}
+	}
+	return filterPods(candidates, func(pod *api.Pod) bool {
+		return perNode[pod.Spec.NodeName] == maxNode
+	})
+}
+
+// fewestConnections returns the candidate whose NATS server has the fewest
+// client connections. Servers which could not be polled are preferred, and
+// ties go to the highest ranked pod.
+func (c *Cluster) fewestConnections(candidates []*api.Pod) *api.Pod {
+	conns := map[string]int{}
+	for _, m := range c.status.Members {
+		if len(m.ServerID) == 0 {
+			conns[m.Name] = -1
+			continue
+		}
+		conns[m.Name] = m.Connections
+	}
+
+	var victim *api.Pod
+	for _, pod := range candidates {
+		switch {
+		case victim == nil, conns[pod.Name] < conns[victim.Name]:
+			victim = pod
+		case conns[pod.Name] == conns[victim.Name] && memberRank(pod) > memberRank(victim):
+			victim = pod
+		}
+	}
+	return victim
+}
+
+func filterPods(pods []*api.Pod, keep func(*api.Pod) bool) []*api.Pod {
+	var res []*api.Pod
+	for _, pod := range pods {
+		if keep(pod) {
+			res = append(res, pod)
+		}
+	}
+	return res
+}
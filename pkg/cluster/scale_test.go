@@ -0,0 +1,124 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+type testPod struct {
+	name     string
+	index    int
+	version  string
+	notReady bool
+	conns    int
+}
+
+func makeTestPods(pods []testPod) []*api.Pod {
+	var res []*api.Pod
+	for _, p := range pods {
+		pod := &api.Pod{}
+		pod.Name = p.name
+		pod.Labels = map[string]string{}
+		if p.index >= 0 {
+			pod.Labels["nats_member"] = strconv.Itoa(p.index)
+		}
+		pod.Annotations = map[string]string{"nats.version": p.version}
+		ready := api.ConditionTrue
+		if p.notReady {
+			ready = api.ConditionFalse
+		}
+		pod.Status.Conditions = []api.PodCondition{{Type: api.PodReady, Status: ready}}
+		res = append(res, pod)
+	}
+	return res
+}
+
+func TestPickPodToRemove(t *testing.T) {
+	tests := []struct {
+		name   string
+		pods   []testPod
+		victim string
+	}{
+		{
+			name: "not ready first",
+			pods: []testPod{
+				{name: "a-0", index: 0, version: "1.0.0", conns: 5},
+				{name: "a-1", index: 1, version: "1.0.0", notReady: true, conns: 9},
+				{name: "a-2", index: 2, version: "1.0.0", conns: 0},
+			},
+			victim: "a-1",
+		},
+		{
+			name: "outdated next",
+			pods: []testPod{
+				{name: "a-0", index: 0, version: "0.9.0", conns: 7},
+				{name: "a-1", index: 1, version: "1.0.0", conns: 1},
+				{name: "a-2", index: 2, version: "1.0.0", conns: 0},
+			},
+			victim: "a-0",
+		},
+		{
+			name: "fewest connections",
+			pods: []testPod{
+				{name: "a-0", index: 0, version: "1.0.0", conns: 1},
+				{name: "a-1", index: 1, version: "1.0.0", conns: 3},
+				{name: "a-2", index: 2, version: "1.0.0", conns: 2},
+			},
+			victim: "a-0",
+		},
+		{
+			name: "highest index on ties",
+			pods: []testPod{
+				{name: "a-0", index: 0, version: "1.0.0", conns: 2},
+				{name: "a-3", index: 3, version: "1.0.0", conns: 2},
+				{name: "a-1", index: 1, version: "1.0.0", conns: 2},
+			},
+			victim: "a-3",
+		},
+		{
+			name: "pods without identity before members on ties",
+			pods: []testPod{
+				{name: "a-0", index: 0, version: "1.0.0", conns: 2},
+				{name: "legacy", index: -1, version: "1.0.0", conns: 2},
+				{name: "a-1", index: 1, version: "1.0.0", conns: 2},
+			},
+			victim: "legacy",
+		},
+	}
+	for _, tt := range tests {
+		c := &Cluster{
+			spec:         &spec.ClusterSpec{Version: "1.0.0"},
+			status:       &spec.ClusterStatus{},
+			memberRoutes: map[string]*natsutil.Routez{},
+		}
+		for _, p := range tt.pods {
+			c.status.Members = append(c.status.Members, spec.MemberStatus{Name: p.name, ServerID: "id-" + p.name, Connections: p.conns})
+			c.memberRoutes[p.name] = &natsutil.Routez{NumRoutes: len(tt.pods) - 1}
+		}
+		victim := c.pickPodToRemove(makeTestPods(tt.pods))
+		if victim == nil {
+			t.Errorf("%s: got no pod, want %s", tt.name, tt.victim)
+		} else if victim.Name != tt.victim {
+			t.Errorf("%s: got %s, want %s", tt.name, victim.Name, tt.victim)
+		}
+	}
+}
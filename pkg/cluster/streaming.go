@@ -0,0 +1,105 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// reconcileStreaming keeps a NATS Streaming server made from the current
+// pod template running on top of the NATS cluster, or removes it if
+// streaming is disabled. Failed or outdated servers are replaced, which
+// loses the messages of a memory store.
+func (c *Cluster) reconcileStreaming(members int) error {
+	podList, err := c.kclient.Pods(c.namespace).List(k8sutil.StreamingPodListOpt(c.name))
+	if err != nil {
+		return fmt.Errorf("failed to list NATS Streaming pods: %v", err)
+	}
+
+	var current *api.Pod
+	hash := ""
+	if c.spec.Streaming != nil {
+		hash = k8sutil.StreamingPodTemplateHash(c.name, c.spec)
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if current == nil && c.spec.Streaming != nil && pod.Status.Phase != api.PodFailed &&
+			k8sutil.GetPodTemplateHash(pod) == hash {
+			current = pod
+			continue
+		}
+		c.logger.Infof("Removing NATS Streaming pod %q", pod.Name)
+		if err := c.removePod(pod.Name); err != nil {
+			return err
+		}
+	}
+
+	if c.spec.Streaming == nil {
+		if c.status.GetCondition(spec.ClusterConditionStreamingReady) != nil {
+			c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionFalse, "StreamingDisabled",
+				"NATS Streaming is disabled.")
+		}
+		return nil
+	}
+	if current != nil {
+		if api.IsPodReady(current) {
+			c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionTrue, "Running",
+				fmt.Sprintf("NATS Streaming server %s is running.", current.Name))
+		} else {
+			c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionFalse, "Starting",
+				fmt.Sprintf("NATS Streaming server %s is starting.", current.Name))
+		}
+		return nil
+	}
+	if members == 0 {
+		// the streaming server needs NATS to connect to
+		return nil
+	}
+
+	if c.spec.Storage != nil && c.spec.Streaming.StoreType == spec.StoreTypeFile {
+		if err := k8sutil.CreatePVC(c.kclient, c.namespace, c.name, k8sutil.StreamingPVCName(c.name), c.storagePolicy()); err != nil {
+			return err
+		}
+	}
+	restored, err := c.restoreStreamingStore()
+	if err != nil {
+		c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionFalse, "RestoreFailed", err.Error())
+		return err
+	}
+	if !restored {
+		c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionFalse, "Restoring",
+			"NATS Streaming store is being restored.")
+		return nil
+	}
+
+	c.logger.Infof("Creating NATS Streaming server")
+	pod, err := k8sutil.CreateAndWaitPod(c.kclient, c.namespace, k8sutil.MakeStreamingPodSpec(c.name, c.spec), c.podCreationTimeout())
+	if err != nil {
+		c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionFalse, "CreationFailed", err.Error())
+		return fmt.Errorf("failed to create NATS Streaming server: %v", err)
+	}
+	podsCreated.WithLabelValues(c.name).Inc()
+	c.status.SetCondition(spec.ClusterConditionStreamingReady, api.ConditionTrue, "Running",
+		fmt.Sprintf("NATS Streaming server %s is running.", pod.Name))
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/wait"
+)
+
+const (
+	reasonHealthCheckFailed = "HealthCheckFailed"
+	reasonRollbackFailed    = "RollbackFailed"
+)
+
+// desiredSpec returns the spec the NATS pods are reconciled to. After a
+// failed upgrade, it is the current spec with the previous version if the
+// upgrade policy asks for a rollback.
+func (c *Cluster) desiredSpec() *spec.ClusterSpec {
+	if !c.rollingBack() {
+		return c.spec
+	}
+	cs := *c.spec
+	cs.Version = c.status.PreviousVersion
+	return &cs
+}
+
+// rollingBack reports whether the NATS servers are rolled back to the
+// previous version after a failed upgrade.
+func (c *Cluster) rollingBack() bool {
+	cond := c.status.GetCondition(spec.ClusterConditionUpgradeFailed)
+	return cond != nil && cond.Status == api.ConditionTrue && cond.Reason == reasonHealthCheckFailed &&
+		c.spec.Upgrade != nil && c.spec.Upgrade.Rollback && len(c.status.PreviousVersion) != 0
+}
+
+// upgradePaused reports whether the rollout is paused after a failed
+// upgrade, or a failed rollback.
+func (c *Cluster) upgradePaused() bool {
+	cond := c.status.GetCondition(spec.ClusterConditionUpgradeFailed)
+	return cond != nil && cond.Status == api.ConditionTrue && !c.rollingBack()
+}
+
+// failUpgrade records that an upgraded NATS server failed its health check.
+func (c *Cluster) failUpgrade(err error) {
+	reason := reasonHealthCheckFailed
+	if c.rollingBack() {
+		reason = reasonRollbackFailed
+	}
+	c.logger.Errorf("Upgrade failed (%s): %v", reason, err)
+	c.status.SetCondition(spec.ClusterConditionUpgradeFailed, api.ConditionTrue, reason, err.Error())
+	if err := k8sutil.CreateClusterEvent(c.kclient, c.namespace, c.name, api.EventTypeWarning, reason, err.Error()); err != nil {
+		c.logger.Warningf("Failed to record upgrade failure event: %v", err)
+	}
+}
+
+// resumeUpgrade lets the rollout continue after the spec was updated.
+func (c *Cluster) resumeUpgrade() {
+	cond := c.status.GetCondition(spec.ClusterConditionUpgradeFailed)
+	if cond == nil || cond.Status != api.ConditionTrue {
+		return
+	}
+	c.status.SetCondition(spec.ClusterConditionUpgradeFailed, api.ConditionFalse, "SpecUpdated",
+		"The cluster spec was updated, resuming the rollout.")
+}
+
+// waitForHealthyMember waits for the NATS server running in pod to report
+// the given version and to have routes to the given number of peers.
+func (c *Cluster) waitForHealthyMember(pod *api.Pod, version string, peers int) error {
+	timeout := constants.DefaultUpgradeHealthTimeoutSeconds * time.Second
+	if c.spec.Upgrade != nil && c.spec.Upgrade.HealthTimeoutSeconds > 0 {
+		timeout = time.Duration(c.spec.Upgrade.HealthTimeoutSeconds) * time.Second
+	}
+
+	var reported string
+	var numRoutes int
+	err := wait.Poll(2*time.Second, timeout, func() (bool, error) {
+		varz, err := natsutil.GetVarz(pod.Status.PodIP)
+		if err != nil {
+			// not ready to answer yet
+			return false, nil
+		}
+		routez, err := natsutil.GetRoutez(pod.Status.PodIP)
+		if err != nil {
+			return false, nil
+		}
+		reported, numRoutes = varz.Version, routez.NumRoutes
+		return versionMatches(version, reported) && numRoutes >= peers, nil
+	})
+	if err != nil {
+		return fmt.Errorf("NATS server %q reports version %q, expected %q, and has routes to %d of %d peers after %v",
+			pod.Name, reported, version, numRoutes, peers, timeout)
+	}
+	return nil
+}
+
+// versionMatches reports whether a NATS server reporting version got runs
+// the image tagged with version want, e.g. "0.9.4" for "0.9.4-linux".
+func versionMatches(want, got string) bool {
+	return len(got) != 0 && (want == got || strings.HasPrefix(want, got+"-"))
+}
@@ -15,9 +15,26 @@
 package constants
 
 const (
-	NatsVersion = "0.9.4"
+	NatsVersion          = "0.9.4"
+	NatsStreamingVersion = "0.4.0"
+
+	// MinioClientImage copies streaming stores to and from object stores.
+	MinioClientImage = "minio/mc"
+	// RouteCheckImage checks whether a NATS server joined the route mesh.
+	RouteCheckImage = "busybox"
 
 	ClientPort     = 4222
 	ClusterPort    = 6222
 	MonitoringPort = 8222
+
+	DefaultMeshPartitionTimeoutSeconds = 120
+	DefaultPodCreationTimeoutSeconds   = 60
+	DefaultDrainTimeoutSeconds         = 120
+	DefaultPendingTimeoutSeconds       = 300
+	DefaultJoinTimeoutSeconds          = 300
+	DefaultFailedPodsHistoryLimit      = 3
+	DefaultUpgradeHealthTimeoutSeconds = 120
+
+	DefaultServiceAccountUserTTLSeconds = 3600
+	DefaultServiceAccountTokenAudience  = "nats"
 )
@@ -20,10 +20,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/fakod/nats-operator/pkg/accounts"
+	"github.com/fakod/nats-operator/pkg/backup"
 	"github.com/fakod/nats-operator/pkg/cluster"
+	"github.com/fakod/nats-operator/pkg/jetstream"
 	"github.com/fakod/nats-operator/pkg/spec"
 	"github.com/fakod/nats-operator/pkg/util/k8sutil"
 
@@ -32,16 +36,35 @@ import (
 	unversionedAPI "k8s.io/kubernetes/pkg/api/unversioned"
 	"k8s.io/kubernetes/pkg/apis/extensions"
 	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/util/validation"
 )
 
 const (
 	tprName = "management.nats.io"
+
+	defaultStorageClassName = "nats-operator"
 )
 
 var (
-	supportedPVProvisioners = map[string]struct{}{
-		"kubernetes.io/gce-pd":  {},
-		"kubernetes.io/aws-ebs": {},
+	// resourceTPRs are the resources managed next to the NATS clusters,
+	// mapped to their description.
+	resourceTPRs = map[string]string{
+		"nats-backup.nats.io":       "Manage backups of NATS Streaming stores",
+		"nats-stream.nats.io":       "Manage JetStream streams",
+		"nats-consumer.nats.io":     "Manage JetStream consumers",
+		"nats-account.nats.io":      "Manage NATS accounts",
+		"nats-user.nats.io":         "Manage NATS users",
+		"nats-service-role.nats.io": "Manage NATS permissions of Kubernetes service accounts",
+		"nats-binding.nats.io":      "Bind Kubernetes service accounts to NATS service roles",
+	}
+
+	// knownPVProvisioners maps the provisioners the operator knows to the
+	// default parameters of the storage class it creates for them. Other
+	// provisioners, e.g. CSI drivers, are used without default parameters.
+	knownPVProvisioners = map[string]map[string]string{
+		"kubernetes.io/gce-pd":  {"type": "pd-ssd"},
+		"kubernetes.io/aws-ebs": {"type": "gp2"},
+		"rancher.io/local-path": {},
 	}
 
 	ErrVersionOutdated = errors.New("Requested version is outdated.")
@@ -66,25 +89,65 @@ type Controller struct {
 	clusters    map[string]*cluster.Cluster
 	stopChMap   map[string]chan struct{}
 	waitCluster sync.WaitGroup
+	// rejected holds the clusters not started because their spec is
+	// invalid, mapped to whether they existed before the operator started.
+	rejected map[string]bool
 }
 
 type Config struct {
-	Namespace     string
-	MasterHost    string
-	KubeCli       *unversioned.Client
+	Namespace  string
+	MasterHost string
+	KubeCli    *unversioned.Client
+	// PVProvisioner is the provisioner of the storage class the operator
+	// creates for the NATS clusters. No storage class is created when empty.
 	PVProvisioner string
+	// PVParameters are provisioner-specific parameters of the storage
+	// class, e.g. the disk type, zones or encryption. They override the
+	// defaults of known provisioners.
+	PVParameters map[string]string
+	// StorageClassName is the name of the storage class the operator
+	// creates. If it's not set, the default is "nats-operator".
+	StorageClassName string
+	// MetricsAddress is the address, e.g. ":8080", where the Prometheus
+	// metrics endpoint listens. The endpoint is disabled when empty.
+	MetricsAddress string
 }
 
 func (c *Config) validate() error {
-	if _, ok := supportedPVProvisioners[c.PVProvisioner]; !ok {
-		return fmt.Errorf(
-			"persistent volume provisioner %s is not supported: options = %v",
-			c.PVProvisioner, supportedPVProvisioners,
-		)
+	if len(c.PVProvisioner) == 0 {
+		return nil
+	}
+	if errs := validation.IsQualifiedName(c.PVProvisioner); len(errs) != 0 {
+		return fmt.Errorf("invalid persistent volume provisioner %q: %s", c.PVProvisioner, strings.Join(errs, ", "))
 	}
 	return nil
 }
 
+// storageClass returns the name of the storage class the operator manages,
+// or an empty string if it manages none.
+func (c *Config) storageClass() string {
+	if len(c.PVProvisioner) == 0 {
+		return ""
+	}
+	if len(c.StorageClassName) != 0 {
+		return c.StorageClassName
+	}
+	return defaultStorageClassName
+}
+
+// storageClassParameters returns the parameters of the storage class the
+// operator manages.
+func (c *Config) storageClassParameters() map[string]string {
+	params := map[string]string{}
+	for k, v := range knownPVProvisioners[c.PVProvisioner] {
+		params[k] = v
+	}
+	for k, v := range c.PVParameters {
+		params[k] = v
+	}
+	return params
+}
+
 func New(cfg Config) *Controller {
 	if err := cfg.validate(); err != nil {
 		panic(err)
@@ -95,6 +158,7 @@ func New(cfg Config) *Controller {
 		Config:    cfg,
 		clusters:  make(map[string]*cluster.Cluster),
 		stopChMap: map[string]chan struct{}{},
+		rejected:  map[string]bool{},
 	}
 }
 
@@ -104,6 +168,10 @@ func (c *Controller) Run() error {
 		err          error
 	)
 
+	if len(c.MetricsAddress) != 0 {
+		go c.serveMetrics()
+	}
+
 	for {
 		watchVersion, err = c.initResource()
 		if err == nil {
@@ -115,7 +183,13 @@ func (c *Controller) Run() error {
 		// TODO: add max retry?
 	}
 
+	resourceStopC := make(chan struct{})
+	go backup.New(c.KubeCli, c.Namespace).Run(resourceStopC)
+	go jetstream.New(c.KubeCli, c.Namespace).Run(resourceStopC)
+	go accounts.New(c.KubeCli, c.Namespace).Run(resourceStopC)
+
 	defer func() {
+		close(resourceStopC)
 		for _, stopC := range c.stopChMap {
 			close(stopC)
 		}
@@ -129,32 +203,51 @@ func (c *Controller) Run() error {
 			clusterName := event.Object.ObjectMeta.Name
 			switch event.Type {
 			case "ADDED":
-				clusterSpec := &event.Object.Spec
-
-				stopC := make(chan struct{})
-				c.stopChMap[clusterName] = stopC
-
-				nc := cluster.New(c.KubeCli, clusterName, c.Namespace, clusterSpec, stopC, &c.waitCluster)
-				c.clusters[clusterName] = nc
+				if err := event.Object.Spec.Validate(); err != nil {
+					c.rejectCluster(event.Object, false, err)
+					break
+				}
+				c.startCluster(event.Object, false)
 			case "MODIFIED":
+				if restored, ok := c.rejected[clusterName]; ok {
+					if err := event.Object.Spec.Validate(); err != nil {
+						c.rejectCluster(event.Object, restored, err)
+						break
+					}
+					c.startCluster(event.Object, restored)
+					break
+				}
 				if c.clusters[clusterName] == nil {
 					c.logger.Warningf("Ignoring modification event: cluster %q not found (or dead)", clusterName)
 					break
 				}
 				c.clusters[clusterName].Update(&event.Object.Spec)
 			case "DELETED":
+				if _, ok := c.rejected[clusterName]; ok {
+					delete(c.rejected, clusterName)
+					break
+				}
 				if c.clusters[clusterName] == nil {
 					c.logger.Warningf("Ignoring deletion event: cluster %q not found (or dead)", clusterName)
 					break
 				}
 				c.clusters[clusterName].Delete()
 				delete(c.clusters, clusterName)
+				clustersManaged.Set(float64(len(c.clusters)))
 			}
 		}
 	}()
 	return <-errCh
 }
 
+func (c *Controller) clusterConfig() cluster.Config {
+	return cluster.Config{
+		KubeCli:      c.KubeCli,
+		Namespace:    c.Namespace,
+		StorageClass: c.storageClass(),
+	}
+}
+
 func (c *Controller) findAllClusters() (string, error) {
 	c.logger.Info("Retrieving existing NATS clusters...")
 	resp, err := k8sutil.ListClusters(c.MasterHost, c.Namespace, c.KubeCli.RESTClient.Client)
@@ -166,16 +259,55 @@ func (c *Controller) findAllClusters() (string, error) {
 	if err := d.Decode(list); err != nil {
 		return "", err
 	}
-	for _, item := range list.Items {
-		stopC := make(chan struct{})
-		c.stopChMap[item.Name] = stopC
-
-		nc := cluster.Restore(c.KubeCli, item.Name, c.Namespace, &item.Spec, stopC, &c.waitCluster)
-		c.clusters[item.Name] = nc
+	for i := range list.Items {
+		item := &list.Items[i]
+		if err := item.Spec.Validate(); err != nil {
+			c.rejectCluster(item, true, err)
+			continue
+		}
+		c.startCluster(item, true)
 	}
 	return list.ListMeta.ResourceVersion, nil
 }
 
+// startCluster starts managing the given cluster, restoring a cluster which
+// existed before the operator started.
+func (c *Controller) startCluster(cl *spec.NatsCluster, restored bool) {
+	if _, ok := c.rejected[cl.Name]; ok {
+		delete(c.rejected, cl.Name)
+		cl.Status.SetCondition(spec.ClusterConditionSpecRejected, k8sapi.ConditionFalse, "SpecAccepted",
+			"The cluster spec was accepted.")
+	}
+	stopC := make(chan struct{})
+	c.stopChMap[cl.Name] = stopC
+
+	var nc *cluster.Cluster
+	if restored {
+		nc = cluster.Restore(c.clusterConfig(), cl, stopC, &c.waitCluster)
+	} else {
+		nc = cluster.New(c.clusterConfig(), cl, stopC, &c.waitCluster)
+	}
+	c.clusters[cl.Name] = nc
+	clustersManaged.Set(float64(len(c.clusters)))
+}
+
+// rejectCluster records why the spec of a cluster was rejected in its
+// status. The cluster is started once its spec is fixed.
+func (c *Controller) rejectCluster(cl *spec.NatsCluster, restored bool, err error) {
+	c.logger.Errorf("Rejecting invalid cluster %q: %v", cl.Name, err)
+	c.rejected[cl.Name] = restored
+	// writing the status triggers a modification event, which is not
+	// written again
+	if cond := cl.Status.GetCondition(spec.ClusterConditionSpecRejected); cond != nil &&
+		cond.Status == k8sapi.ConditionTrue && cond.Message == err.Error() {
+		return
+	}
+	cl.Status.SetCondition(spec.ClusterConditionSpecRejected, k8sapi.ConditionTrue, "InvalidSpec", err.Error())
+	if _, err := k8sutil.UpdateClusterTPRObject(c.KubeCli.RESTClient, c.Namespace, cl); err != nil {
+		c.logger.Warningf("Failed to record rejection of cluster %q: %v", cl.Name, err)
+	}
+}
+
 func (c *Controller) initResource() (string, error) {
 	watchVersion := "0"
 	err := c.createTPR()
@@ -190,13 +322,20 @@ func (c *Controller) initResource() (string, error) {
 		}
 	}
 
-	// TODO use for streaming
-	//err = k8sutil.CreateStorageClass(c.KubeCli, c.PVProvisioner)
-	//if err != nil {
-	//	if !k8sutil.IsKubernetesResourceAlreadyExistError(err) {
-	//		return "", fmt.Errorf("fail to create storage class: %v", err)
-	//	}
-	//}
+	for name, desc := range resourceTPRs {
+		if err := c.createResourceTPR(name, desc); err != nil && !k8sutil.IsKubernetesResourceAlreadyExistError(err) {
+			return "", fmt.Errorf("Failed to create TPR %q: %v", name, err)
+		}
+	}
+
+	if sc := c.storageClass(); len(sc) != 0 {
+		err = k8sutil.CreateStorageClass(c.KubeCli, sc, c.PVProvisioner, c.storageClassParameters())
+		if _, changed := err.(*k8sutil.StorageClassChangedError); changed {
+			c.logger.Warningf("%v, not the configured ones: delete it to provision new volumes with the configured ones", err)
+		} else if err != nil {
+			return "", fmt.Errorf("fail to create storage class: %v", err)
+		}
+	}
 	return watchVersion, nil
 }
 
@@ -218,6 +357,20 @@ func (c *Controller) createTPR() error {
 	return k8sutil.WaitTPRReady(c.KubeCli.Client, 3*time.Second, 30*time.Second, c.MasterHost, c.Namespace)
 }
 
+func (c *Controller) createResourceTPR(name, description string) error {
+	tpr := &extensions.ThirdPartyResource{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: name,
+		},
+		Versions: []extensions.APIVersion{
+			{Name: "v1"},
+		},
+		Description: description,
+	}
+	_, err := c.KubeCli.ThirdPartyResources().Create(tpr)
+	return err
+}
+
 func (c *Controller) monitor(watchVersion string) (<-chan *Event, <-chan error) {
 	host := c.MasterHost
 	ns := c.Namespace
@@ -249,6 +402,7 @@ func (c *Controller) monitor(watchVersion string) (<-chan *Event, <-chan error)
 				if err != nil {
 					if err == io.EOF { // apiserver will close stream periodically
 						c.logger.Debug("API server closed stream")
+						watchRestarts.Inc()
 						break
 					}
 
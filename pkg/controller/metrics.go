@@ -0,0 +1,59 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	// registers the Kubernetes API client latency and result metrics.
+	_ "k8s.io/kubernetes/pkg/client/metrics/prometheus"
+)
+
+const (
+	metricsPath = "/metrics"
+)
+
+var (
+	clustersManaged = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nats_operator",
+		Subsystem: "controller",
+		Name:      "clusters_managed",
+		Help:      "Number of NATS clusters managed by the operator.",
+	})
+
+	watchRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nats_operator",
+		Subsystem: "controller",
+		Name:      "watch_restarts_total",
+		Help:      "Total number of times the NATS cluster watch was restarted.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(clustersManaged)
+	prometheus.MustRegister(watchRestarts)
+}
+
+// serveMetrics exposes the operator metrics in the Prometheus format.
+func (c *Controller) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, prometheus.Handler())
+
+	c.logger.Infof("Serving metrics on %s%s", c.MetricsAddress, metricsPath)
+	if err := http.ListenAndServe(c.MetricsAddress, mux); err != nil {
+		c.logger.Errorf("Failed to serve metrics: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/accounts"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"github.com/blang/semver"
+	"github.com/nats-io/nats.go"
+	kunversioned "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// minDescriptionVersion is the first NATS version keeping the description
+// of streams and consumers, which marks the ones the operator manages.
+var minDescriptionVersion = semver.MustParse("2.3.0")
+
+// clientCache connects to each cluster, as each account, at most once per
+// sync.
+type clientCache struct {
+	kclient   *kunversioned.Client
+	namespace string
+
+	clients map[string]*natsutil.JetStreamClient
+	errs    map[string]error
+}
+
+func newClientCache(kclient *kunversioned.Client, ns string) *clientCache {
+	return &clientCache{
+		kclient:   kclient,
+		namespace: ns,
+		clients:   map[string]*natsutil.JetStreamClient{},
+		errs:      map[string]error{},
+	}
+}
+
+// get returns a JetStream client of the account of the cluster, which must
+// have JetStream enabled. The account is only used if the cluster has
+// accounts enabled.
+func (cc *clientCache) get(clusterName, accountName string) (*natsutil.JetStreamClient, error) {
+	key := clusterName + "/" + accountName
+	if js, ok := cc.clients[key]; ok {
+		return js, nil
+	}
+	if err, ok := cc.errs[key]; ok {
+		return nil, err
+	}
+	js, err := cc.connect(clusterName, accountName)
+	if err != nil {
+		cc.errs[key] = err
+		return nil, err
+	}
+	cc.clients[key] = js
+	return js, nil
+}
+
+func (cc *clientCache) connect(clusterName, accountName string) (*natsutil.JetStreamClient, error) {
+	cl, err := k8sutil.GetClusterTPRObject(cc.kclient.RESTClient, cc.namespace, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster %q: %v", clusterName, err)
+	}
+	if cl.Spec.JetStream == nil {
+		return nil, fmt.Errorf("cluster %q does not have JetStream enabled", clusterName)
+	}
+	if v, err := semver.Parse(cl.Spec.Version); err != nil || v.LT(minDescriptionVersion) {
+		return nil, fmt.Errorf("managing the streams of cluster %q requires NATS version %v or later", clusterName, minDescriptionVersion)
+	}
+	var options []nats.Option
+	if cl.Spec.Accounts != nil {
+		if len(accountName) == 0 {
+			return nil, fmt.Errorf("cluster %q has accounts enabled, accountName must be set", clusterName)
+		}
+		opt, err := accounts.AccountUser(cc.kclient, cc.namespace, accountName)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, opt)
+	}
+	tc, err := k8sutil.ClientTLSConfig(cc.kclient, cc.namespace, &cl.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if tc != nil {
+		options = append(options, nats.Secure(tc))
+	}
+	js, err := natsutil.ConnectJetStream(k8sutil.ClientURL(clusterName), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to cluster %q: %v", clusterName, err)
+	}
+	return js, nil
+}
+
+func (cc *clientCache) close() {
+	for _, js := range cc.clients {
+		js.Close()
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+	"github.com/fakod/nats-operator/pkg/util/k8sutil"
+	"github.com/fakod/nats-operator/pkg/util/natsutil"
+
+	"github.com/Sirupsen/logrus"
+	kunversioned "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+var syncInterval = 30 * time.Second
+
+// managedPrefix starts the description of the streams and consumers
+// created by the operator, which tells them apart from the ones created by
+// clients when looking for orphans.
+const managedPrefix = "Managed by nats-operator"
+
+type streamRef struct {
+	cluster, account, stream string
+}
+
+type consumerRef struct {
+	cluster, account, stream, durable string
+}
+
+// Controller reconciles the JetStream streams and consumers declared by the
+// NatsStream and NatsConsumer objects of a namespace through the JetStream
+// API of their clusters, and reports their state in the objects' status.
+//
+// The streams and consumers created by the controller are marked in their
+// description. On each sync, the marked ones no object declares anymore are
+// deleted, including the ones whose object was deleted while the operator
+// was not running. A stream declared by several objects belongs to the
+// oldest one, the others are rejected.
+type Controller struct {
+	logger *logrus.Entry
+
+	kclient   *kunversioned.Client
+	namespace string
+}
+
+func New(kclient *kunversioned.Client, ns string) *Controller {
+	return &Controller{
+		logger:    logrus.WithField("pkg", "jetstream"),
+		kclient:   kclient,
+		namespace: ns,
+	}
+}
+
+// Run syncs the streams and consumers periodically until stopC is closed.
+func (c *Controller) Run(stopC <-chan struct{}) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			c.sync()
+		}
+	}
+}
+
+func (c *Controller) sync() {
+	clusters, err := k8sutil.ListClusterTPRObjects(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list clusters: %v", err)
+		return
+	}
+	accounts, err := k8sutil.ListAccounts(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list accounts: %v", err)
+		return
+	}
+	streams, err := k8sutil.ListStreams(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list streams: %v", err)
+		return
+	}
+	consumers, err := k8sutil.ListConsumers(c.kclient.RESTClient, c.namespace)
+	if err != nil {
+		c.logger.Errorf("Failed to list consumers: %v", err)
+		return
+	}
+
+	cc := newClientCache(c.kclient, c.namespace)
+	defer cc.close()
+
+	// the account is ignored by clusters without accounts
+	withAccounts := map[string]bool{}
+	for i := range clusters {
+		withAccounts[clusters[i].Name] = clusters[i].Spec.Accounts != nil
+	}
+	accountOf := func(clusterName, accountName string) string {
+		if !withAccounts[clusterName] {
+			return ""
+		}
+		return accountName
+	}
+
+	owners := map[streamRef]*spec.NatsStream{}
+	for i := range streams.Items {
+		s := &streams.Items[i]
+		ref := streamRef{s.Spec.ClusterName, accountOf(s.Spec.ClusterName, s.Spec.AccountName), s.StreamName()}
+		if o, ok := owners[ref]; !ok || olderThan(s, o) {
+			owners[ref] = s
+		}
+	}
+	declared := map[consumerRef]bool{}
+	for i := range consumers.Items {
+		cons := &consumers.Items[i]
+		cs := &cons.Spec
+		declared[consumerRef{cs.ClusterName, accountOf(cs.ClusterName, cs.AccountName), cs.StreamName, cons.DurableName()}] = true
+	}
+	c.deleteOrphans(cc, clusters, accounts, owners, declared)
+
+	for i := range streams.Items {
+		s := &streams.Items[i]
+		var status spec.StreamStatus
+		ref := streamRef{s.Spec.ClusterName, accountOf(s.Spec.ClusterName, s.Spec.AccountName), s.StreamName()}
+		if o := owners[ref]; o != s {
+			status.Reason = fmt.Sprintf("stream %q is already declared by NatsStream %q", ref.stream, o.Name)
+		} else {
+			status = c.reconcileStream(cc, s)
+		}
+		if reflect.DeepEqual(status, s.Status) {
+			continue
+		}
+		s.Status = status
+		if err := k8sutil.UpdateStreamTPRObject(c.kclient.RESTClient, c.namespace, s); err != nil {
+			c.logger.Warningf("Failed to update status of stream %q: %v", s.Name, err)
+		}
+	}
+	for i := range consumers.Items {
+		cons := &consumers.Items[i]
+		status := c.reconcileConsumer(cc, cons)
+		if reflect.DeepEqual(status, cons.Status) {
+			continue
+		}
+		cons.Status = status
+		if err := k8sutil.UpdateConsumerTPRObject(c.kclient.RESTClient, c.namespace, cons); err != nil {
+			c.logger.Warningf("Failed to update status of consumer %q: %v", cons.Name, err)
+		}
+	}
+}
+
+// olderThan reports whether the stream object a was created before b, by
+// name for objects created at the same time.
+func olderThan(a, b *spec.NatsStream) bool {
+	if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// deleteOrphans deletes the managed streams and consumers no object
+// declares, in every account of the clusters with JetStream. Consumers go
+// before their streams.
+func (c *Controller) deleteOrphans(cc *clientCache, clusters []spec.NatsCluster, accounts *spec.NatsAccountList,
+	streams map[streamRef]*spec.NatsStream, consumers map[consumerRef]bool) {
+	var refs []streamRef
+	for i := range clusters {
+		cl := &clusters[i]
+		switch {
+		case cl.Spec.JetStream == nil:
+		case cl.Spec.Accounts == nil:
+			refs = append(refs, streamRef{cluster: cl.Name})
+		default:
+			for j := range accounts.Items {
+				if a := &accounts.Items[j]; a.Spec.ClusterName == cl.Name {
+					refs = append(refs, streamRef{cluster: cl.Name, account: a.Name})
+				}
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		js, err := cc.get(ref.cluster, ref.account)
+		if err != nil {
+			c.logger.Warningf("Failed to look for orphaned streams of cluster %q: %v", ref.cluster, err)
+			continue
+		}
+		infos, err := js.Streams()
+		if err != nil {
+			c.logger.Warningf("Failed to list streams of cluster %q: %v", ref.cluster, err)
+			continue
+		}
+		for _, si := range infos {
+			ref.stream = si.Config.Name
+			c.deleteOrphanedConsumers(js, ref, consumers)
+			if !managed(si.Config.Description) || streams[ref] != nil {
+				continue
+			}
+			c.logger.Infof("Deleting stream %q of cluster %q", ref.stream, ref.cluster)
+			if err := js.DeleteStream(ref.stream); err != nil && err != natsutil.ErrJetStreamNotFound {
+				c.logger.Warningf("Failed to delete stream %q of cluster %q: %v", ref.stream, ref.cluster, err)
+			}
+		}
+	}
+}
+
+func (c *Controller) deleteOrphanedConsumers(js *natsutil.JetStreamClient, ref streamRef, consumers map[consumerRef]bool) {
+	infos, err := js.Consumers(ref.stream)
+	if err != nil {
+		c.logger.Warningf("Failed to list consumers of stream %q: %v", ref.stream, err)
+		return
+	}
+	for _, ci := range infos {
+		durable := ci.Config.Durable
+		if !managed(ci.Config.Description) || consumers[consumerRef{ref.cluster, ref.account, ref.stream, durable}] {
+			continue
+		}
+		c.logger.Infof("Deleting consumer %q of stream %q of cluster %q", durable, ref.stream, ref.cluster)
+		if err := js.DeleteConsumer(ref.stream, durable); err != nil && err != natsutil.ErrJetStreamNotFound {
+			c.logger.Warningf("Failed to delete consumer %q of stream %q: %v", durable, ref.stream, err)
+		}
+	}
+}
+
+// managed reports whether a stream or consumer description marks it as
+// created by the operator.
+func managed(description string) bool {
+	return strings.HasPrefix(description, managedPrefix)
+}
+
+// reconcileStream creates the stream, or updates it if its configuration
+// differs from the spec, and returns its status.
+func (c *Controller) reconcileStream(cc *clientCache, s *spec.NatsStream) spec.StreamStatus {
+	if err := s.Validate(); err != nil {
+		return spec.StreamStatus{Reason: fmt.Sprintf("invalid spec: %v", err)}
+	}
+	js, err := cc.get(s.Spec.ClusterName, s.Spec.AccountName)
+	if err != nil {
+		return spec.StreamStatus{Reason: err.Error()}
+	}
+
+	cfg := streamConfig(s)
+	si, err := js.StreamInfo(cfg.Name)
+	switch {
+	case err == natsutil.ErrJetStreamNotFound:
+		c.logger.Infof("Creating stream %q of cluster %q", cfg.Name, s.Spec.ClusterName)
+		si, err = js.AddStream(cfg)
+	case err == nil && !reflect.DeepEqual(si.Config, *cfg):
+		c.logger.Infof("Updating stream %q of cluster %q", cfg.Name, s.Spec.ClusterName)
+		si, err = js.UpdateStream(cfg)
+	}
+	if err != nil {
+		return spec.StreamStatus{Reason: err.Error()}
+	}
+	return spec.StreamStatus{
+		Ready:     true,
+		Messages:  si.State.Msgs,
+		Bytes:     si.State.Bytes,
+		Consumers: si.State.Consumers,
+	}
+}
+
+// reconcileConsumer creates the consumer, or updates it if its
+// configuration differs from the spec, and returns its status. The server
+// rejects the changes it does not support, which are reported in the status.
+func (c *Controller) reconcileConsumer(cc *clientCache, cons *spec.NatsConsumer) spec.ConsumerStatus {
+	if err := cons.Validate(); err != nil {
+		return spec.ConsumerStatus{Reason: fmt.Sprintf("invalid spec: %v", err)}
+	}
+	js, err := cc.get(cons.Spec.ClusterName, cons.Spec.AccountName)
+	if err != nil {
+		return spec.ConsumerStatus{Reason: err.Error()}
+	}
+
+	cfg := consumerConfig(cons)
+	ci, err := js.ConsumerInfo(cons.Spec.StreamName, cfg.Durable)
+	switch {
+	case err == natsutil.ErrJetStreamNotFound:
+		c.logger.Infof("Creating consumer %q of stream %q", cfg.Durable, cons.Spec.StreamName)
+		ci, err = js.AddConsumer(cons.Spec.StreamName, cfg)
+	case err == nil && !reflect.DeepEqual(ci.Config, *cfg):
+		c.logger.Infof("Updating consumer %q of stream %q", cfg.Durable, cons.Spec.StreamName)
+		ci, err = js.AddConsumer(cons.Spec.StreamName, cfg)
+	}
+	if err != nil {
+		return spec.ConsumerStatus{Reason: err.Error()}
+	}
+	return spec.ConsumerStatus{
+		Ready:          true,
+		NumPending:     ci.NumPending,
+		NumAckPending:  ci.NumAckPending,
+		NumRedelivered: ci.NumRedelivered,
+	}
+}
+
+// streamConfig returns the configuration of a stream, with the defaults
+// the server reports for the settings which are not set by user.
+func streamConfig(s *spec.NatsStream) *natsutil.StreamConfig {
+	ss := &s.Spec
+	cfg := &natsutil.StreamConfig{
+		Name:        s.StreamName(),
+		Description: fmt.Sprintf("%s from NatsStream %s/%s", managedPrefix, s.Namespace, s.Name),
+		Subjects:    ss.Subjects,
+		Retention:   ss.Retention,
+		Storage:     ss.Storage,
+		Replicas:    ss.Replicas,
+		MaxBytes:    ss.MaxBytes,
+		MaxMsgs:     ss.MaxMsgs,
+	}
+	if len(cfg.Retention) == 0 {
+		cfg.Retention = spec.StreamRetentionLimits
+	}
+	if len(cfg.Storage) == 0 {
+		cfg.Storage = spec.StreamStorageFile
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 1
+	}
+	if d, err := time.ParseDuration(ss.MaxAge); err == nil {
+		cfg.MaxAge = int64(d)
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+	return cfg
+}
+
+// consumerConfig returns the configuration of a consumer, with the
+// defaults the server reports for the settings which are not set by user.
+func consumerConfig(cons *spec.NatsConsumer) *natsutil.ConsumerConfig {
+	cs := &cons.Spec
+	cfg := &natsutil.ConsumerConfig{
+		Durable:       cons.DurableName(),
+		Description:   fmt.Sprintf("%s from NatsConsumer %s/%s", managedPrefix, cons.Namespace, cons.Name),
+		DeliverPolicy: cs.DeliverPolicy,
+		AckPolicy:     cs.AckPolicy,
+		FilterSubject: cs.FilterSubject,
+		MaxDeliver:    cs.MaxDeliver,
+		AckWait:       int64(30 * time.Second),
+	}
+	if len(cfg.DeliverPolicy) == 0 {
+		cfg.DeliverPolicy = spec.DeliverAll
+	}
+	if len(cfg.AckPolicy) == 0 {
+		cfg.AckPolicy = spec.AckExplicit
+	}
+	if cfg.MaxDeliver == 0 {
+		cfg.MaxDeliver = -1
+	}
+	if d, err := time.ParseDuration(cs.AckWait); err == nil {
+		cfg.AckWait = int64(d)
+	}
+	return cfg
+}
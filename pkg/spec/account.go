@@ -0,0 +1,306 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blang/semver"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+const (
+	// AccountResolverFull keeps the account JWTs in a directory on the
+	// volume of every server, and takes updates at runtime.
+	AccountResolverFull = "full"
+	// AccountResolverMemory preloads the account JWTs from the server
+	// configuration. The servers are replaced, one at a time, to take
+	// updates, so it is meant for static accounts. User revocations are
+	// not written to it.
+	AccountResolverMemory = "memory"
+
+	ExportTypeStream  = "stream"
+	ExportTypeService = "service"
+)
+
+// minAccountResolverVersion is the first NATS version with the full
+// account resolver.
+var minAccountResolverVersion = semver.MustParse("2.2.0")
+
+// AccountsPolicy enables decentralized authentication: clients are
+// authenticated with user JWTs issued by NatsAccount objects, whose
+// account JWTs are signed by an operator key managed by the operator.
+type AccountsPolicy struct {
+	// Resolver is the built-in resolver the servers look up account JWTs
+	// in, "full" or "memory". The operator pushes account updates to the
+	// full resolver, which needs storage. The memory resolver is for static
+	// accounts: the servers are replaced to take updates, and users are
+	// never revoked, so the credentials of deleted NatsUser and NatsBinding
+	// objects, and the credentials replaced by a rotation, stay valid.
+	// If it's not set by user, the default is "full".
+	Resolver string `json:"resolver,omitempty"`
+
+	// ServiceAccountAuth lets clients authenticate with the token of their
+	// Kubernetes service account instead of a credentials secret.
+	ServiceAccountAuth *ServiceAccountAuthPolicy `json:"serviceAccountAuth,omitempty"`
+}
+
+func (cs *ClusterSpec) validateAccounts() error {
+	ap := cs.Accounts
+	if ap == nil {
+		return nil
+	}
+	if v, err := semver.Parse(cs.Version); err != nil || v.LT(minAccountResolverVersion) {
+		return fmt.Errorf("accounts require NATS version %v or later", minAccountResolverVersion)
+	}
+	switch ap.Resolver {
+	case "", AccountResolverFull:
+		if cs.Storage == nil {
+			// the account JWTs would be lost along with the servers
+			return errors.New("the full account resolver requires storage")
+		}
+	case AccountResolverMemory:
+		if ap.ServiceAccountAuth != nil {
+			return errors.New("service account authentication requires the full account resolver")
+		}
+	default:
+		return fmt.Errorf("unsupported account resolver %q", ap.Resolver)
+	}
+	if cs.Streaming != nil {
+		// the streaming server has no credentials to connect with
+		return errors.New("streaming is not supported with accounts")
+	}
+	if sa := ap.ServiceAccountAuth; sa != nil {
+		if v, _ := semver.Parse(cs.Version); v.LT(minAuthCalloutVersion) {
+			return fmt.Errorf("service account authentication requires NATS version %v or later", minAuthCalloutVersion)
+		}
+		if cs.TLS == nil {
+			// clients send their token to the servers
+			return errors.New("service account authentication requires tls")
+		}
+		if sa.UserTTLSeconds < 0 {
+			return errors.New("serviceAccountAuth: userTTLSeconds must not be negative")
+		}
+	}
+	return nil
+}
+
+// MemoryResolver tells whether the servers preload the account JWTs from
+// their configuration.
+func (ap *AccountsPolicy) MemoryResolver() bool {
+	return ap != nil && ap.Resolver == AccountResolverMemory
+}
+
+// NatsAccount declares a NATS account of a NatsCluster with accounts
+// enabled.
+type NatsAccount struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 AccountSpec   `json:"spec"`
+	Status               AccountStatus `json:"status"`
+}
+
+type NatsAccountList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsAccount `json:"items"`
+}
+
+type AccountSpec struct {
+	// ClusterName is the name of the NatsCluster the account belongs to.
+	ClusterName string `json:"clusterName"`
+
+	// Exports are the subjects other accounts may import.
+	Exports []AccountExport `json:"exports,omitempty"`
+	// Imports are the subjects imported from other accounts.
+	Imports []AccountImport `json:"imports,omitempty"`
+
+	// Limits bound the account. Limits which are not set by user are
+	// unlimited, except JetStream which is disabled.
+	Limits *AccountLimits `json:"limits,omitempty"`
+}
+
+type AccountExport struct {
+	Name    string `json:"name,omitempty"`
+	Subject string `json:"subject"`
+	// Type is "stream" or "service".
+	Type string `json:"type"`
+}
+
+type AccountImport struct {
+	Name string `json:"name,omitempty"`
+	// Account is the name of the NatsAccount exporting the subject.
+	Account string `json:"account"`
+	Subject string `json:"subject"`
+	// LocalSubject is the subject in the importing account.
+	// If it's not set by user, the default is the exported subject.
+	LocalSubject string `json:"localSubject,omitempty"`
+	// Type is "stream" or "service".
+	Type string `json:"type"`
+}
+
+type AccountLimits struct {
+	MaxConnections   int64 `json:"maxConnections,omitempty"`
+	MaxSubscriptions int64 `json:"maxSubscriptions,omitempty"`
+	MaxData          int64 `json:"maxData,omitempty"`
+	MaxPayload       int64 `json:"maxPayload,omitempty"`
+	MaxImports       int64 `json:"maxImports,omitempty"`
+	MaxExports       int64 `json:"maxExports,omitempty"`
+
+	// JetStream enables JetStream for the account within these limits.
+	JetStream *AccountJetStreamLimits `json:"jetstream,omitempty"`
+}
+
+type AccountJetStreamLimits struct {
+	// MaxMemoryStore and MaxFileStore are quantities, e.g. "1Gi".
+	// Unlimited if not set.
+	MaxMemoryStore string `json:"maxMemoryStore,omitempty"`
+	MaxFileStore   string `json:"maxFileStore,omitempty"`
+	MaxStreams     int64  `json:"maxStreams,omitempty"`
+	MaxConsumers   int64  `json:"maxConsumers,omitempty"`
+}
+
+type AccountStatus struct {
+	// PublicKey is the public NKey identifying the account.
+	PublicKey string `json:"publicKey,omitempty"`
+	// Ready tells whether the servers have the current account JWT, or,
+	// with the memory resolver, whether it is stored for them to preload.
+	Ready bool `json:"ready"`
+	// Reason explains why the account is not ready.
+	Reason string `json:"reason,omitempty"`
+	// ClaimsHash identifies the claims of the account JWT last pushed.
+	ClaimsHash string `json:"claimsHash,omitempty"`
+	// RevokedUsers are the users whose credentials were replaced, or whose
+	// NatsUser or NatsBinding object was deleted. The servers of a cluster
+	// with the memory resolver do not enforce them.
+	RevokedUsers []RevokedUser `json:"revokedUsers,omitempty"`
+}
+
+// RevokedUser invalidates the JWTs of a user issued before a time.
+type RevokedUser struct {
+	PublicKey string           `json:"publicKey"`
+	Time      unversioned.Time `json:"time"`
+}
+
+// Validate returns an error if the account spec is invalid.
+func (a *NatsAccount) Validate() error {
+	as := &a.Spec
+	if len(as.ClusterName) == 0 {
+		return errors.New("clusterName must be set")
+	}
+	for _, e := range as.Exports {
+		if len(e.Subject) == 0 {
+			return errors.New("exports: subject must be set")
+		}
+		if err := validateExportType(e.Type); err != nil {
+			return fmt.Errorf("exports: %v", err)
+		}
+	}
+	for _, i := range as.Imports {
+		if len(i.Subject) == 0 || len(i.Account) == 0 {
+			return errors.New("imports: subject and account must be set")
+		}
+		if err := validateExportType(i.Type); err != nil {
+			return fmt.Errorf("imports: %v", err)
+		}
+	}
+	if l := as.Limits; l != nil && l.JetStream != nil {
+		for name, q := range map[string]string{"maxMemoryStore": l.JetStream.MaxMemoryStore, "maxFileStore": l.JetStream.MaxFileStore} {
+			if len(q) == 0 {
+				continue
+			}
+			if _, err := resource.ParseQuantity(q); err != nil {
+				return fmt.Errorf("limits.jetstream.%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateExportType(t string) error {
+	switch t {
+	case ExportTypeStream, ExportTypeService:
+		return nil
+	}
+	return fmt.Errorf("unknown type %q", t)
+}
+
+// NatsUser declares a user of a NatsAccount. The operator issues its JWT
+// and writes its credentials file to a secret for applications to mount.
+type NatsUser struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 UserSpec   `json:"spec"`
+	Status               UserStatus `json:"status"`
+}
+
+type NatsUserList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsUser `json:"items"`
+}
+
+type UserSpec struct {
+	// AccountName is the name of the NatsAccount the user belongs to.
+	AccountName string `json:"accountName"`
+
+	// Permissions restrict the subjects of the user. The user may publish
+	// and subscribe to any subject of the account if not set.
+	Permissions *UserPermissions `json:"permissions,omitempty"`
+
+	// CredentialsSecret is the name of the secret the credentials file is
+	// written to, under the "user.creds" key.
+	// If it's not set by user, the default is "<name>-nats-creds".
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+type UserPermissions struct {
+	Publish   *SubjectPermission `json:"publish,omitempty"`
+	Subscribe *SubjectPermission `json:"subscribe,omitempty"`
+}
+
+type SubjectPermission struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+type UserStatus struct {
+	// PublicKey is the public NKey identifying the user.
+	PublicKey string `json:"publicKey,omitempty"`
+	// Ready tells whether the credentials match the spec.
+	Ready bool `json:"ready"`
+	// Reason explains why the user is not ready.
+	Reason string `json:"reason,omitempty"`
+}
+
+// CredentialsSecretName returns the name of the secret holding the
+// credentials file of the user.
+func (u *NatsUser) CredentialsSecretName() string {
+	if len(u.Spec.CredentialsSecret) != 0 {
+		return u.Spec.CredentialsSecret
+	}
+	return u.Name + "-nats-creds"
+}
+
+// Validate returns an error if the user spec is invalid.
+func (u *NatsUser) Validate() error {
+	if len(u.Spec.AccountName) == 0 {
+		return errors.New("accountName must be set")
+	}
+	return nil
+}
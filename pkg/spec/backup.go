@@ -0,0 +1,179 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/robfig/cron"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+const BackupStorageTypeS3 StorageType = "S3"
+
+var (
+	// bucketNameRe matches the names of S3 buckets.
+	bucketNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	// objectNameRe matches the snapshot names, and the path segments of
+	// prefixes, so that they cannot escape the bucket.
+	objectNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+)
+
+// SnapshotPhase is the lifecycle phase of a snapshot.
+type SnapshotPhase string
+
+const (
+	SnapshotRunning   SnapshotPhase = "Running"
+	SnapshotSucceeded SnapshotPhase = "Succeeded"
+	SnapshotFailed    SnapshotPhase = "Failed"
+	// SnapshotDeleting is the phase of a snapshot removed by the retention.
+	SnapshotDeleting SnapshotPhase = "Deleting"
+)
+
+// NatsBackup takes snapshots of the NATS Streaming file store of a
+// NatsCluster.
+type NatsBackup struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 BackupSpec   `json:"spec"`
+	Status               BackupStatus `json:"status"`
+}
+
+// BackupSpec describes the snapshots taken of a streaming file store.
+//
+// Snapshots copy the file store while the streaming server keeps running,
+// so they are not taken at a single point in time: messages written during
+// the copy may be missing or only partly copied, and are lost when the
+// snapshot is restored.
+type BackupSpec struct {
+	// ClusterName is the name of the NatsCluster whose streaming store is
+	// backed up. The cluster must use a file store on persistent storage.
+	ClusterName string `json:"clusterName"`
+
+	// StorageType specifies where snapshots are stored.
+	// If it's not set by user, the default is "S3".
+	StorageType StorageType `json:"storageType,omitempty"`
+
+	// S3 is the S3-compatible object store snapshots are stored in.
+	S3 *S3Target `json:"s3,omitempty"`
+
+	// Schedule is a standard cron expression of when snapshots are taken.
+	// If it's not set by user, a single snapshot is taken.
+	Schedule string `json:"schedule,omitempty"`
+
+	// MaxSnapshots is the number of successful snapshots kept, older ones
+	// are deleted. If it's not set by user, all snapshots are kept.
+	MaxSnapshots int `json:"maxSnapshots,omitempty"`
+}
+
+// S3Target is a location in an S3-compatible object store, e.g. MinIO.
+type S3Target struct {
+	// Endpoint is the URL of the object store, e.g. "http://minio:9000".
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	// Prefix is prepended to the snapshot names in the bucket.
+	Prefix string `json:"prefix,omitempty"`
+	// CredentialsSecret is the name of the secret holding the "accessKey"
+	// and "secretKey" of the object store.
+	CredentialsSecret string `json:"credentialsSecret"`
+	// Insecure disables the verification of the TLS certificate.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+type BackupStatus struct {
+	// Snapshots lists the snapshots taken, oldest first.
+	Snapshots []SnapshotStatus `json:"snapshots,omitempty"`
+}
+
+type SnapshotStatus struct {
+	// Name is the name of the snapshot in the object store.
+	Name      string           `json:"name"`
+	Phase     SnapshotPhase    `json:"phase"`
+	StartTime unversioned.Time `json:"startTime"`
+	Message   string           `json:"message,omitempty"`
+}
+
+// RestorePolicy seeds the NATS Streaming file store of a new cluster from
+// a snapshot.
+type RestorePolicy struct {
+	// BackupName is the name of the NatsBackup holding the snapshot.
+	BackupName string `json:"backupName"`
+	// Snapshot is the name of the snapshot. If it's not set by user, the
+	// latest successful snapshot is restored.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// Validate returns an error if the backup spec is invalid.
+func (bs *BackupSpec) Validate() error {
+	if len(bs.ClusterName) == 0 {
+		return errors.New("clusterName must be set")
+	}
+	switch bs.StorageType {
+	case "", BackupStorageTypeS3:
+	default:
+		return fmt.Errorf("unsupported backup storage type %q", bs.StorageType)
+	}
+	if bs.S3 == nil || len(bs.S3.Endpoint) == 0 || len(bs.S3.Bucket) == 0 || len(bs.S3.CredentialsSecret) == 0 {
+		return errors.New("s3: endpoint, bucket and credentialsSecret must be set")
+	}
+	if !bucketNameRe.MatchString(bs.S3.Bucket) {
+		return fmt.Errorf("s3: invalid bucket name %q", bs.S3.Bucket)
+	}
+	if len(bs.S3.Prefix) != 0 {
+		for _, seg := range strings.Split(strings.TrimSuffix(bs.S3.Prefix, "/"), "/") {
+			if !objectNameRe.MatchString(seg) {
+				return fmt.Errorf("s3: invalid prefix %q", bs.S3.Prefix)
+			}
+		}
+	}
+	if len(bs.Schedule) != 0 {
+		if _, err := cron.ParseStandard(bs.Schedule); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+	}
+	if bs.MaxSnapshots < 0 {
+		return errors.New("maxSnapshots must not be negative")
+	}
+	return nil
+}
+
+// ValidateSnapshotName returns an error if name is not a valid snapshot
+// name.
+func ValidateSnapshotName(name string) error {
+	if !objectNameRe.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// LatestSnapshot returns the latest successful snapshot, or nil if none.
+func (s *BackupStatus) LatestSnapshot() *SnapshotStatus {
+	for i := len(s.Snapshots) - 1; i >= 0; i-- {
+		if s.Snapshots[i].Phase == SnapshotSucceeded {
+			return &s.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+type NatsBackupList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsBackup `json:"items"`
+}
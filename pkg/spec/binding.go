@@ -0,0 +1,199 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+const (
+	// RotateCredentialsAnnotation on a NatsBinding rotates its credentials
+	// whenever its value changes, e.g. to the current time. The previous
+	// credentials are revoked, unless the cluster uses the memory resolver.
+	RotateCredentialsAnnotation = "nats.io/rotate-credentials"
+
+	// BindingAuthCredentials issues a credentials secret to the service
+	// account of a binding.
+	BindingAuthCredentials = "credentials"
+	// BindingAuthServiceAccountToken lets the pods of the service accounts
+	// of a binding authenticate with their service account token.
+	BindingAuthServiceAccountToken = "serviceAccountToken"
+
+	// credentialsSecretSuffix ends the names of the credentials secrets
+	// written to the namespaces of service accounts, which keeps them apart
+	// from the secrets of applications.
+	credentialsSecretSuffix = "-nats-creds"
+)
+
+// minAuthCalloutVersion is the first NATS version delegating client
+// authentication to an auth callout service.
+var minAuthCalloutVersion = semver.MustParse("2.10.0")
+
+// ServiceAccountAuthPolicy enables an auth callout service, run by the
+// operator, which authenticates clients presenting the token of their
+// Kubernetes service account with the TokenReview API, and authorizes them
+// with the role of the NatsBinding of their service account.
+//
+// Clients connect with TLS, with the sentinel credentials the operator
+// writes to the "<cluster>-nats-sentinel" secret of the namespace of each
+// binding, which grant nothing by themselves, and pass their token as the
+// auth token. Only projected service account tokens bound to the audience
+// are accepted, so that the tokens of the pods, which grant access to the
+// Kubernetes API, are never sent to the servers.
+type ServiceAccountAuthPolicy struct {
+	// Audience is the audience the service account tokens must be bound
+	// to. If it's not set by user, the default is "nats".
+	Audience string `json:"audience,omitempty"`
+
+	// UserTTLSeconds is the lifetime of the user JWTs issued to clients.
+	// Clients are disconnected when it expires, and authenticate again
+	// with their current token when they reconnect.
+	// If it's not set by user, the default is 3600.
+	UserTTLSeconds int `json:"userTTLSeconds,omitempty"`
+}
+
+// NatsServiceRole is a set of permissions in a NatsAccount which Kubernetes
+// service accounts are bound to.
+type NatsServiceRole struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 ServiceRoleSpec `json:"spec"`
+}
+
+type NatsServiceRoleList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsServiceRole `json:"items"`
+}
+
+type ServiceRoleSpec struct {
+	// AccountName is the name of the NatsAccount the users of the role
+	// belong to.
+	AccountName string `json:"accountName"`
+
+	// Permissions restrict the subjects of the users of the role.
+	Permissions *UserPermissions `json:"permissions,omitempty"`
+}
+
+// NatsBinding binds a Kubernetes service account to a NatsServiceRole. The
+// operator issues a NATS user with the role's permissions for the binding,
+// and writes its credentials file to a secret in the namespace of the
+// service account for its pods to mount. With the "serviceAccountToken"
+// authentication, no user is issued ahead: pods authenticate with their
+// service account token, see ServiceAccountAuthPolicy.
+type NatsBinding struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 BindingSpec   `json:"spec"`
+	Status               BindingStatus `json:"status"`
+}
+
+type NatsBindingList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsBinding `json:"items"`
+}
+
+type BindingSpec struct {
+	// ServiceAccount is the service account bound. Its name may be left
+	// empty with the "serviceAccountToken" authentication, to bind all the
+	// service accounts of the namespace.
+	ServiceAccount ServiceAccountRef `json:"serviceAccount"`
+	// RoleName is the name of the NatsServiceRole bound.
+	RoleName string `json:"roleName"`
+
+	// Authentication is how the pods of the service account authenticate,
+	// "credentials" or "serviceAccountToken". A client bound to several
+	// roles with its token selects one by passing its name as user name.
+	// If it's not set by user, the default is "credentials".
+	Authentication string `json:"authentication,omitempty"`
+
+	// CredentialsSecret is the name of the secret, in the namespace of the
+	// service account, the credentials file is written to, under the
+	// "user.creds" key. It must end with "-nats-creds", and an existing
+	// secret is only replaced if the operator made it for the binding.
+	// If it's not set by user, the default is "<service account>-<role>-nats-creds".
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+type ServiceAccountRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name,omitempty"`
+}
+
+type BindingStatus struct {
+	// PublicKey is the public NKey identifying the user of the binding.
+	PublicKey string `json:"publicKey,omitempty"`
+	// Ready tells whether the credentials match the spec.
+	Ready bool `json:"ready"`
+	// Reason explains why the binding is not ready.
+	Reason string `json:"reason,omitempty"`
+	// Rotation is the value of the rotation annotation the credentials
+	// were last rotated for.
+	Rotation string `json:"rotation,omitempty"`
+}
+
+// UsesServiceAccountToken tells whether the pods of the service account of
+// the binding authenticate with their service account token.
+func (b *NatsBinding) UsesServiceAccountToken() bool {
+	return b.Spec.Authentication == BindingAuthServiceAccountToken
+}
+
+// Matches tells whether the binding binds the service account.
+func (b *NatsBinding) Matches(namespace, name string) bool {
+	sa := b.Spec.ServiceAccount
+	return sa.Namespace == namespace && (len(sa.Name) == 0 || sa.Name == name)
+}
+
+// CredentialsSecretName returns the name of the secret holding the
+// credentials file of the binding.
+func (b *NatsBinding) CredentialsSecretName() string {
+	if len(b.Spec.CredentialsSecret) != 0 {
+		return b.Spec.CredentialsSecret
+	}
+	return b.Spec.ServiceAccount.Name + "-" + b.Spec.RoleName + credentialsSecretSuffix
+}
+
+// Validate returns an error if the binding spec is invalid.
+func (b *NatsBinding) Validate() error {
+	switch b.Spec.Authentication {
+	case "", BindingAuthCredentials:
+		if len(b.Spec.ServiceAccount.Name) == 0 {
+			return errors.New("serviceAccount: name must be set with credentials authentication")
+		}
+		if s := b.Spec.CredentialsSecret; len(s) != 0 && !strings.HasSuffix(s, credentialsSecretSuffix) {
+			return fmt.Errorf("credentialsSecret must end with %q", credentialsSecretSuffix)
+		}
+	case BindingAuthServiceAccountToken:
+		if len(b.Spec.CredentialsSecret) != 0 {
+			return errors.New("credentialsSecret must not be set with serviceAccountToken authentication")
+		}
+	default:
+		return fmt.Errorf("unknown authentication %q", b.Spec.Authentication)
+	}
+	if len(b.Spec.ServiceAccount.Namespace) == 0 {
+		return errors.New("serviceAccount: namespace must be set")
+	}
+	if len(b.Spec.RoleName) == 0 {
+		return errors.New("roleName must be set")
+	}
+	return nil
+}
@@ -15,21 +15,43 @@
 package spec
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/blang/semver"
+
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
 	"k8s.io/kubernetes/pkg/api/unversioned"
 )
 
-// TODO: supports object store like s3
 type StorageType string
 
+// VolumeReclaimPolicy selects what happens to the volumes of the NATS
+// servers when the cluster is deleted.
+type VolumeReclaimPolicy string
+
+// ScaleDownPolicy selects the NATS server removed when scaling down.
+type ScaleDownPolicy string
+
 const (
 	BackupStorageTypePersistentVolume = "PersistentVolume"
+
+	VolumeReclaimDelete VolumeReclaimPolicy = "Delete"
+	VolumeReclaimRetain VolumeReclaimPolicy = "Retain"
+
+	// ScaleDownFewestConnections removes the server with the fewest clients.
+	ScaleDownFewestConnections ScaleDownPolicy = "FewestConnections"
+	// ScaleDownSpread removes the server from the zone, then the node,
+	// hosting the most servers of the cluster.
+	ScaleDownSpread ScaleDownPolicy = "Spread"
 )
 
 type NatsCluster struct {
 	unversioned.TypeMeta `json:",inline"`
 	api.ObjectMeta       `json:"metadata,omitempty"`
-	Spec                 ClusterSpec `json:"spec"`
+	Spec                 ClusterSpec   `json:"spec"`
+	Status               ClusterStatus `json:"status"`
 }
 
 type ClusterSpec struct {
@@ -47,6 +69,11 @@ type ClusterSpec struct {
 	// If it's not set by user, the default is "PersistentVolume".
 	StorageType StorageType `json:"storageType"`
 
+	// Storage gives each NATS server, and the NATS Streaming server, a
+	// persistent volume for its data. A replaced server reattaches the
+	// volume of the server it replaces.
+	Storage *StoragePolicy `json:"storage,omitempty"`
+
 	// Paused is to pause the control of the operator for the cluster.
 	Paused bool `json:"paused,omitempty"`
 
@@ -58,4 +85,287 @@ type ClusterSpec struct {
 	// AntiAffinity determines if the operator tries to avoid scheduling
 	// NATS pods related to a same cluster onto the same node.
 	AntiAffinity bool `json:"antiAffinity"`
+
+	// MeshPartitionTimeoutSeconds is how long a NATS server may miss a route
+	// to a ready server of the cluster before the operator replaces it.
+	// If it's not set by user, the default is 120 seconds. A negative value
+	// disables the replacement.
+	MeshPartitionTimeoutSeconds int `json:"meshPartitionTimeoutSeconds,omitempty"`
+
+	// Pod defines the policy to create and run the NATS pods.
+	Pod *PodPolicy `json:"pod,omitempty"`
+
+	// ScaleDownPolicy selects which NATS server is removed when the cluster
+	// is scaled down, among the servers which did not join the cluster, or
+	// else the servers not running the expected version, or else all of
+	// them. Ties go to the member with the highest index.
+	// If it's not set by user, the default is "FewestConnections".
+	ScaleDownPolicy ScaleDownPolicy `json:"scaleDownPolicy,omitempty"`
+
+	// ScaleUpBatchSize is the maximum number of NATS pods created at once
+	// when the cluster is scaled up. The operator waits for a batch to
+	// become ready before creating the next one.
+	// If it's not set by user, the default is 1.
+	ScaleUpBatchSize int `json:"scaleUpBatchSize,omitempty"`
+
+	// Upgrade defines how the NATS servers are upgraded.
+	Upgrade *UpgradePolicy `json:"upgrade,omitempty"`
+
+	// VersionPolicy restricts the version changes accepted by the operator.
+	// By default, downgrades and upgrades skipping a major version are
+	// rejected.
+	VersionPolicy *VersionPolicy `json:"versionPolicy,omitempty"`
+
+	// MaintenanceWindow restricts upgrades and scale downs to recurring
+	// periods. Failed NATS servers are replaced at any time.
+	// If it's not set by user, the operator may disrupt servers any time.
+	MaintenanceWindow *MaintenanceWindow `json:"maintenanceWindow,omitempty"`
+
+	// Streaming deploys a NATS Streaming server on top of the NATS cluster.
+	Streaming *StreamingPolicy `json:"streaming,omitempty"`
+
+	// JetStream enables JetStream persistence on the NATS servers.
+	JetStream *JetStreamPolicy `json:"jetstream,omitempty"`
+
+	// Accounts enables decentralized authentication with NATS accounts.
+	Accounts *AccountsPolicy `json:"accounts,omitempty"`
+
+	// TLS requires the clients to connect to the NATS servers with TLS.
+	TLS *TLSPolicy `json:"tls,omitempty"`
+
+	// Restore seeds the NATS Streaming file store from a snapshot before
+	// the streaming server first starts.
+	Restore *RestorePolicy `json:"restore,omitempty"`
+}
+
+// UpgradePolicy defines how the NATS servers are upgraded.
+type UpgradePolicy struct {
+	// HealthTimeoutSeconds is how long an upgraded NATS server has, once
+	// its pod is ready, to report the expected version and routes to all
+	// its peers. Otherwise the rollout is paused and the UpgradeFailed
+	// condition set. If it's not set by user, the default is 120 seconds.
+	HealthTimeoutSeconds int `json:"healthTimeoutSeconds,omitempty"`
+
+	// Rollback makes the operator roll the NATS servers back to the
+	// previous version, recorded in the status, after a failed upgrade.
+	Rollback bool `json:"rollback,omitempty"`
+
+	// Canary makes the operator try a rollout on a few NATS servers first.
+	Canary *CanaryPolicy `json:"canary,omitempty"`
+}
+
+// PromoteCanaryAnnotation is set on a NatsCluster to promote the canaries
+// of a rollout. Its value is the version or the pod template hash of the
+// canaries, as shown in the status.
+const PromoteCanaryAnnotation = "nats.io/promote-canary"
+
+// CanaryPolicy defines how a rollout is first tried on a few NATS servers.
+type CanaryPolicy struct {
+	// Members is the number of NATS servers upgraded first. The rest of
+	// the rollout waits for these canaries to be promoted.
+	Members int `json:"members"`
+
+	// SoakSeconds is how long the canaries must stay healthy before they
+	// are promoted.
+	SoakSeconds int `json:"soakSeconds,omitempty"`
+
+	// ManualPromotion makes the canaries wait for the PromoteCanaryAnnotation
+	// instead of being promoted once they soaked.
+	ManualPromotion bool `json:"manualPromotion,omitempty"`
+}
+
+// TLSPolicy defines the certificate of the client port of the NATS servers.
+type TLSPolicy struct {
+	// ServerSecret is the name of the secret holding the certificate of the
+	// servers, under the "tls.crt" key, its private key, under "tls.key",
+	// and the certificate of the CA which issued it, under "ca.crt", which
+	// the operator verifies the servers with. The certificate must be
+	// valid for the "<cluster>" host name.
+	ServerSecret string `json:"serverSecret"`
+}
+
+// StoragePolicy defines the persistent volumes of the NATS servers.
+type StoragePolicy struct {
+	// StorageClass is the name of a pre-existing storage class the volumes
+	// are provisioned from. If it's not set by user, the storage class
+	// managed by the operator applies, if any, else the default one.
+	StorageClass string `json:"storageClass,omitempty"`
+
+	// Size is the size of each volume, e.g. "1Gi".
+	Size string `json:"size"`
+
+	// ReclaimPolicy selects whether the volumes are deleted with the
+	// cluster. If it's not set by user, the default is "Delete".
+	ReclaimPolicy VolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+}
+
+// PodPolicy defines the policy to create and run the NATS pods.
+type PodPolicy struct {
+	// LivenessProbe tunes the probe restarting a NATS pod whose monitoring
+	// endpoint stopped responding.
+	LivenessProbe *ProbePolicy `json:"livenessProbe,omitempty"`
+
+	// ReadinessProbe tunes the probes telling whether a NATS pod accepts
+	// client connections and joined the route mesh.
+	ReadinessProbe *ProbePolicy `json:"readinessProbe,omitempty"`
+
+	// CreationTimeoutSeconds is how long the operator waits for a new NATS
+	// pod to become ready. If it's not set by user, the default is 60 seconds.
+	CreationTimeoutSeconds int `json:"creationTimeoutSeconds,omitempty"`
+
+	// DrainTimeoutSeconds is how long a NATS server removed by the operator
+	// is given to migrate its clients to the other peers in lame duck mode.
+	// If it's not set by user, the default is 120 seconds.
+	DrainTimeoutSeconds int `json:"drainTimeoutSeconds,omitempty"`
+
+	// PendingTimeoutSeconds is how long a NATS pod may stay pending, e.g.
+	// because it cannot be scheduled, before the operator deletes it.
+	// If it's not set by user, the default is 300 seconds.
+	PendingTimeoutSeconds int `json:"pendingTimeoutSeconds,omitempty"`
+
+	// JoinTimeoutSeconds is how long a running NATS pod may stay out of the
+	// route mesh, e.g. not ready, before the operator replaces it.
+	// If it's not set by user, the default is 300 seconds.
+	JoinTimeoutSeconds int `json:"joinTimeoutSeconds,omitempty"`
+
+	// FailedPodsHistoryLimit is the number of failed NATS pods kept for
+	// debugging. Older ones are deleted once their logs are recorded in an
+	// event. If it's not set by user, the default is 3.
+	FailedPodsHistoryLimit *int `json:"failedPodsHistoryLimit,omitempty"`
+
+	// TerminationGracePeriodSeconds is the time given to a NATS server to
+	// shut down when its pod is deleted by someone else than the operator.
+	// If it's not set by user, the drain timeout applies.
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+}
+
+// ProbePolicy defines the timing of a probe. Fields which are not set by
+// user take the operator defaults.
+type ProbePolicy struct {
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	TimeoutSeconds      int32 `json:"timeoutSeconds,omitempty"`
+	PeriodSeconds       int32 `json:"periodSeconds,omitempty"`
+	SuccessThreshold    int32 `json:"successThreshold,omitempty"`
+	FailureThreshold    int32 `json:"failureThreshold,omitempty"`
+}
+
+// Validate returns an error if the cluster spec is invalid.
+func (cs *ClusterSpec) Validate() error {
+	if cs.Size < 0 {
+		return errors.New("size must not be negative")
+	}
+	if len(cs.Version) != 0 {
+		if _, err := semver.Parse(cs.Version); err != nil {
+			return fmt.Errorf("invalid version %q: %v", cs.Version, err)
+		}
+	}
+	if err := cs.VersionPolicy.validate(); err != nil {
+		return err
+	}
+	if err := cs.MaintenanceWindow.validate(); err != nil {
+		return err
+	}
+	switch cs.StorageType {
+	case "", BackupStorageTypePersistentVolume:
+	default:
+		return fmt.Errorf("unknown storage type %q", cs.StorageType)
+	}
+	if st := cs.Storage; st != nil {
+		if _, err := resource.ParseQuantity(st.Size); err != nil {
+			return fmt.Errorf("storage.size: %v", err)
+		}
+		switch st.ReclaimPolicy {
+		case "", VolumeReclaimDelete, VolumeReclaimRetain:
+		default:
+			return fmt.Errorf("unknown volume reclaim policy %q", st.ReclaimPolicy)
+		}
+	}
+	if err := cs.Streaming.validate(); err != nil {
+		return err
+	}
+	if err := cs.validateJetStream(); err != nil {
+		return err
+	}
+	if err := cs.validateAccounts(); err != nil {
+		return err
+	}
+	if cs.TLS != nil {
+		if len(cs.TLS.ServerSecret) == 0 {
+			return errors.New("tls.serverSecret must be set")
+		}
+		if cs.Streaming != nil {
+			// the streaming server has no CA to verify the servers with
+			return errors.New("streaming is not supported with tls")
+		}
+	}
+	if cs.Restore != nil {
+		if cs.Streaming == nil || cs.Streaming.StoreType != StoreTypeFile || cs.Storage == nil {
+			return errors.New("restore requires a streaming file store on persistent storage")
+		}
+		if len(cs.Restore.BackupName) == 0 {
+			return errors.New("restore.backupName must be set")
+		}
+		if len(cs.Restore.Snapshot) != 0 {
+			if err := ValidateSnapshotName(cs.Restore.Snapshot); err != nil {
+				return fmt.Errorf("restore: %v", err)
+			}
+		}
+	}
+	if cs.ScaleUpBatchSize < 0 {
+		return errors.New("scaleUpBatchSize must not be negative")
+	}
+	switch cs.ScaleDownPolicy {
+	case "", ScaleDownFewestConnections, ScaleDownSpread:
+	default:
+		return fmt.Errorf("unknown scale down policy %q", cs.ScaleDownPolicy)
+	}
+	if u := cs.Upgrade; u != nil {
+		if u.HealthTimeoutSeconds < 0 {
+			return errors.New("upgrade.healthTimeoutSeconds must not be negative")
+		}
+		if u.Canary != nil && (u.Canary.Members < 0 || u.Canary.SoakSeconds < 0) {
+			return errors.New("upgrade.canary: values must not be negative")
+		}
+	}
+	if p := cs.Pod; p != nil {
+		if err := p.LivenessProbe.validate("livenessProbe"); err != nil {
+			return err
+		}
+		if p.LivenessProbe != nil && p.LivenessProbe.SuccessThreshold > 1 {
+			return errors.New("pod.livenessProbe.successThreshold must be 1")
+		}
+		if err := p.ReadinessProbe.validate("readinessProbe"); err != nil {
+			return err
+		}
+		if p.CreationTimeoutSeconds < 0 {
+			return errors.New("pod.creationTimeoutSeconds must not be negative")
+		}
+		if p.DrainTimeoutSeconds < 0 {
+			return errors.New("pod.drainTimeoutSeconds must not be negative")
+		}
+		if p.PendingTimeoutSeconds < 0 {
+			return errors.New("pod.pendingTimeoutSeconds must not be negative")
+		}
+		if p.JoinTimeoutSeconds < 0 {
+			return errors.New("pod.joinTimeoutSeconds must not be negative")
+		}
+		if p.FailedPodsHistoryLimit != nil && *p.FailedPodsHistoryLimit < 0 {
+			return errors.New("pod.failedPodsHistoryLimit must not be negative")
+		}
+		if p.TerminationGracePeriodSeconds != nil && *p.TerminationGracePeriodSeconds < 0 {
+			return errors.New("pod.terminationGracePeriodSeconds must not be negative")
+		}
+	}
+	return nil
+}
+
+func (p *ProbePolicy) validate(name string) error {
+	if p == nil {
+		return nil
+	}
+	if p.InitialDelaySeconds < 0 || p.TimeoutSeconds < 0 || p.PeriodSeconds < 0 ||
+		p.SuccessThreshold < 0 || p.FailureThreshold < 0 {
+		return fmt.Errorf("pod.%s: values must not be negative", name)
+	}
+	return nil
 }
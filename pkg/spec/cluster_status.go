@@ -0,0 +1,173 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+type ClusterConditionType string
+
+const (
+	// ClusterConditionMeshHealthy tells whether every NATS server has
+	// routes to all the other servers of the cluster.
+	ClusterConditionMeshHealthy ClusterConditionType = "MeshHealthy"
+	// ClusterConditionUnschedulable tells whether the operator had to delete
+	// NATS pods which stayed pending for too long.
+	ClusterConditionUnschedulable ClusterConditionType = "Unschedulable"
+	// ClusterConditionUpgradeFailed tells whether an upgraded NATS server
+	// failed its health check, in which case the rollout is paused until
+	// the spec is updated.
+	ClusterConditionUpgradeFailed ClusterConditionType = "UpgradeFailed"
+	// ClusterConditionSpecRejected tells whether the last update of the
+	// cluster spec was rejected, in which case the previous spec still
+	// applies. A cluster whose spec is rejected from the start is not
+	// managed until its spec is fixed.
+	ClusterConditionSpecRejected ClusterConditionType = "SpecRejected"
+	// ClusterConditionMaintenancePending tells whether disruptive changes,
+	// like upgrades or scale downs, wait for the next maintenance window.
+	ClusterConditionMaintenancePending ClusterConditionType = "MaintenancePending"
+	// ClusterConditionStreamingReady tells whether the NATS Streaming server
+	// of the cluster is running.
+	ClusterConditionStreamingReady ClusterConditionType = "StreamingReady"
+)
+
+type ClusterCondition struct {
+	Type               ClusterConditionType `json:"type"`
+	Status             api.ConditionStatus  `json:"status"`
+	Reason             string               `json:"reason,omitempty"`
+	Message            string               `json:"message,omitempty"`
+	LastTransitionTime unversioned.Time     `json:"lastTransitionTime,omitempty"`
+}
+
+type ClusterStatus struct {
+	CurrentVersion string `json:"currentVersion"`
+	TargetVersion  string `json:"targetVersion"`
+	// PreviousVersion is the version the cluster ran before the current
+	// upgrade, which a failed upgrade is rolled back to.
+	PreviousVersion string `json:"previousVersion,omitempty"`
+
+	// RestoredSnapshot is the snapshot the streaming store was seeded from.
+	RestoredSnapshot string `json:"restoredSnapshot,omitempty"`
+
+	// Canary tracks the canaries of the rollout in progress, if any.
+	Canary *CanaryStatus `json:"canary,omitempty"`
+
+	Conditions []ClusterCondition `json:"conditions,omitempty"`
+
+	// Members holds what each running NATS server reports about itself
+	// through its monitoring endpoint.
+	Members []MemberStatus `json:"members,omitempty"`
+}
+
+// CanaryStatus is the state of the canaries of a rollout.
+type CanaryStatus struct {
+	// TemplateHash is the pod template hash of the canaries.
+	TemplateHash string `json:"templateHash"`
+	// Version is the NATS version of the canaries.
+	Version string `json:"version"`
+	// SoakStartTime is when all the canaries were running.
+	SoakStartTime unversioned.Time `json:"soakStartTime,omitempty"`
+	// Promoted tells whether the rollout continues past the canaries.
+	Promoted bool `json:"promoted"`
+}
+
+// MemberStatus is the state of a single NATS server of the cluster.
+type MemberStatus struct {
+	// Name is the name of the pod running the NATS server.
+	Name string `json:"name"`
+	// ServerID is the unique ID the NATS server generated on startup.
+	ServerID string `json:"serverID"`
+	// Version is the version the NATS server is actually running.
+	Version string `json:"version"`
+
+	Connections   int    `json:"connections"`
+	Routes        int    `json:"routes"`
+	InMsgs        int64  `json:"inMsgs"`
+	OutMsgs       int64  `json:"outMsgs"`
+	InBytes       int64  `json:"inBytes"`
+	OutBytes      int64  `json:"outBytes"`
+	SlowConsumers int64  `json:"slowConsumers"`
+	Uptime        string `json:"uptime"`
+
+	// JetStream is the JetStream usage of the server, if enabled.
+	JetStream *JetStreamUsage `json:"jetstream,omitempty"`
+}
+
+func (s *ClusterStatus) UpgradeVersionTo(v string) {
+	if s.TargetVersion != v && len(s.CurrentVersion) != 0 {
+		s.PreviousVersion = s.CurrentVersion
+	}
+	s.TargetVersion = v
+}
+
+// SetVersion records that all NATS servers run version v. The upgrade, or
+// rollback, is complete, so there is no previous version to roll back to.
+func (s *ClusterStatus) SetVersion(v string) {
+	s.TargetVersion = ""
+	s.CurrentVersion = v
+	s.PreviousVersion = ""
+}
+
+// GetCondition returns the condition of the given type, or nil if it was never set.
+func (s *ClusterStatus) GetCondition(t ClusterConditionType) *ClusterCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == t {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition sets the condition of the given type. The transition time
+// is only updated when the condition status changes.
+func (s *ClusterStatus) SetCondition(t ClusterConditionType, status api.ConditionStatus, reason, message string) {
+	c := s.GetCondition(t)
+	if c == nil {
+		s.Conditions = append(s.Conditions, ClusterCondition{Type: t})
+		c = &s.Conditions[len(s.Conditions)-1]
+	}
+	if c.Status != status {
+		c.Status = status
+		c.LastTransitionTime = unversioned.Now()
+	}
+	c.Reason = reason
+	c.Message = message
+}
+
+// Copy returns a deep copy of the status.
+func (s *ClusterStatus) Copy() *ClusterStatus {
+	ns := *s
+	if s.Conditions != nil {
+		ns.Conditions = make([]ClusterCondition, len(s.Conditions))
+		copy(ns.Conditions, s.Conditions)
+	}
+	if s.Canary != nil {
+		canary := *s.Canary
+		ns.Canary = &canary
+	}
+	if s.Members != nil {
+		ns.Members = make([]MemberStatus, len(s.Members))
+		copy(ns.Members, s.Members)
+		for i := range ns.Members {
+			if js := ns.Members[i].JetStream; js != nil {
+				usage := *js
+				ns.Members[i].JetStream = &usage
+			}
+		}
+	}
+	return &ns
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"k8s.io/kubernetes/pkg/api/resource"
+)
+
+// minJetStreamVersion is the first NATS version with JetStream.
+var minJetStreamVersion = semver.MustParse("2.2.0")
+
+// JetStreamPolicy enables JetStream persistence on every NATS server of
+// the cluster. Each server keeps its file store on its own volume, so
+// JetStream requires persistent storage.
+type JetStreamPolicy struct {
+	// MaxMemoryStore is the memory each server may use for memory streams,
+	// e.g. "1Gi". If it's not set by user, the server default is used.
+	MaxMemoryStore string `json:"maxMemoryStore,omitempty"`
+
+	// MaxFileStore is the disk space each server may use for file streams,
+	// e.g. "10Gi". If it's not set by user, the server default is used.
+	MaxFileStore string `json:"maxFileStore,omitempty"`
+
+	// StoreDir is the directory of the file store, relative to the volume
+	// of the server. If it's not set by user, the default is "jetstream".
+	StoreDir string `json:"storeDir,omitempty"`
+
+	// Domain is the JetStream domain of the cluster.
+	Domain string `json:"domain,omitempty"`
+}
+
+func (cs *ClusterSpec) validateJetStream() error {
+	js := cs.JetStream
+	if js == nil {
+		return nil
+	}
+	if v, err := semver.Parse(cs.Version); err != nil || v.LT(minJetStreamVersion) {
+		return fmt.Errorf("jetstream requires NATS version %v or later", minJetStreamVersion)
+	}
+	if cs.Storage == nil {
+		return errors.New("jetstream requires persistent storage")
+	}
+	for name, q := range map[string]string{"maxMemoryStore": js.MaxMemoryStore, "maxFileStore": js.MaxFileStore} {
+		if len(q) == 0 {
+			continue
+		}
+		if _, err := resource.ParseQuantity(q); err != nil {
+			return fmt.Errorf("jetstream.%s: %v", name, err)
+		}
+	}
+	if strings.HasPrefix(js.StoreDir, "/") || strings.Contains(js.StoreDir, "..") {
+		return fmt.Errorf("jetstream.storeDir %q must be relative to the volume", js.StoreDir)
+	}
+	if strings.ContainsAny(js.Domain, " \t\n\".*>") {
+		return fmt.Errorf("invalid jetstream domain %q", js.Domain)
+	}
+	return nil
+}
+
+// JetStreamUsage is the JetStream usage a NATS server reports on /jsz.
+type JetStreamUsage struct {
+	Memory    uint64 `json:"memory"`
+	Storage   uint64 `json:"storage"`
+	Streams   int    `json:"streams"`
+	Consumers int    `json:"consumers"`
+	Messages  uint64 `json:"messages"`
+	Bytes     uint64 `json:"bytes"`
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// MaintenanceWindow defines recurring periods during which the operator may
+// disrupt the NATS servers, e.g. to upgrade them or scale the cluster down.
+type MaintenanceWindow struct {
+	// Schedule is a standard cron expression of when windows start,
+	// e.g. "0 2 * * 6" for Saturdays at 2am.
+	Schedule string `json:"schedule"`
+
+	// DurationSeconds is how long each window lasts.
+	DurationSeconds int `json:"durationSeconds"`
+
+	// TimeZone is the name of the time zone the schedule is in, e.g.
+	// "Europe/Berlin". If it's not set by user, the default is UTC.
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+func (w *MaintenanceWindow) validate() error {
+	if w == nil {
+		return nil
+	}
+	if _, err := cron.ParseStandard(w.Schedule); err != nil {
+		return fmt.Errorf("maintenanceWindow.schedule: %v", err)
+	}
+	if w.DurationSeconds <= 0 {
+		return errors.New("maintenanceWindow.durationSeconds must be positive")
+	}
+	if _, err := time.LoadLocation(w.TimeZone); err != nil {
+		return fmt.Errorf("maintenanceWindow.timeZone: %v", err)
+	}
+	return nil
+}
+
+// Open reports whether a window is open at the given time, and when the
+// next window starts otherwise. A nil window is always open.
+func (w *MaintenanceWindow) Open(now time.Time) (bool, time.Time, error) {
+	if w == nil {
+		return true, now, nil
+	}
+	sched, err := cron.ParseStandard(w.Schedule)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	now = now.In(loc)
+	duration := time.Duration(w.DurationSeconds) * time.Second
+	if start := sched.Next(now.Add(-duration)); !start.After(now) {
+		return true, start, nil
+	}
+	return false, sched.Next(now), nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+const (
+	StreamRetentionLimits    = "limits"
+	StreamRetentionInterest  = "interest"
+	StreamRetentionWorkQueue = "workqueue"
+
+	StreamStorageFile   = "file"
+	StreamStorageMemory = "memory"
+
+	DeliverAll  = "all"
+	DeliverLast = "last"
+	DeliverNew  = "new"
+
+	AckExplicit = "explicit"
+	AckAll      = "all"
+	AckNone     = "none"
+
+	maxStreamReplicas = 5
+)
+
+// NatsStream declares a JetStream stream of a NatsCluster.
+type NatsStream struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 StreamSpec   `json:"spec"`
+	Status               StreamStatus `json:"status"`
+}
+
+type NatsStreamList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsStream `json:"items"`
+}
+
+type StreamSpec struct {
+	// ClusterName is the name of the NatsCluster the stream belongs to.
+	// The cluster must have JetStream enabled.
+	ClusterName string `json:"clusterName"`
+	// AccountName is the name of the NatsAccount owning the stream, which
+	// must be set if the cluster has accounts enabled.
+	AccountName string `json:"accountName,omitempty"`
+
+	// Name is the name of the stream.
+	// If it's not set by user, the default is the name of the NatsStream.
+	Name string `json:"name,omitempty"`
+
+	// Subjects are the subjects the stream stores messages from.
+	Subjects []string `json:"subjects"`
+
+	// Retention is "limits", "interest" or "workqueue".
+	// If it's not set by user, the default is "limits".
+	Retention string `json:"retention,omitempty"`
+
+	// Storage is "file" or "memory".
+	// If it's not set by user, the default is "file".
+	Storage string `json:"storage,omitempty"`
+
+	// Replicas is the number of copies of the stream in the cluster.
+	// If it's not set by user, the default is 1.
+	Replicas int `json:"replicas,omitempty"`
+
+	// MaxAge is how long messages are kept, e.g. "24h". Unlimited if not set.
+	MaxAge string `json:"maxAge,omitempty"`
+	// MaxBytes is the size of the stream. Unlimited if not set.
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// MaxMsgs is the number of messages of the stream. Unlimited if not set.
+	MaxMsgs int64 `json:"maxMsgs,omitempty"`
+}
+
+type StreamStatus struct {
+	// Ready tells whether the stream matches its spec.
+	Ready bool `json:"ready"`
+	// Reason explains why the stream is not ready.
+	Reason string `json:"reason,omitempty"`
+
+	Messages  uint64 `json:"messages"`
+	Bytes     uint64 `json:"bytes"`
+	Consumers int    `json:"consumers"`
+}
+
+// StreamName returns the name of the JetStream stream.
+func (s *NatsStream) StreamName() string {
+	if len(s.Spec.Name) != 0 {
+		return s.Spec.Name
+	}
+	return s.Name
+}
+
+// Validate returns an error if the stream spec is invalid.
+func (s *NatsStream) Validate() error {
+	ss := &s.Spec
+	if len(ss.ClusterName) == 0 {
+		return errors.New("clusterName must be set")
+	}
+	if err := validateJetStreamName(s.StreamName()); err != nil {
+		return err
+	}
+	if len(ss.Subjects) == 0 {
+		return errors.New("subjects must be set")
+	}
+	switch ss.Retention {
+	case "", StreamRetentionLimits, StreamRetentionInterest, StreamRetentionWorkQueue:
+	default:
+		return fmt.Errorf("unknown retention %q", ss.Retention)
+	}
+	switch ss.Storage {
+	case "", StreamStorageFile, StreamStorageMemory:
+	default:
+		return fmt.Errorf("unknown storage %q", ss.Storage)
+	}
+	if ss.Replicas < 0 || ss.Replicas > maxStreamReplicas {
+		return fmt.Errorf("replicas must be between 1 and %d", maxStreamReplicas)
+	}
+	if len(ss.MaxAge) != 0 {
+		if _, err := time.ParseDuration(ss.MaxAge); err != nil {
+			return fmt.Errorf("maxAge: %v", err)
+		}
+	}
+	if ss.MaxBytes < 0 || ss.MaxMsgs < 0 {
+		return errors.New("maxBytes and maxMsgs must not be negative")
+	}
+	return nil
+}
+
+// NatsConsumer declares a durable JetStream consumer of a stream.
+type NatsConsumer struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Spec                 ConsumerSpec   `json:"spec"`
+	Status               ConsumerStatus `json:"status"`
+}
+
+type NatsConsumerList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NatsConsumer `json:"items"`
+}
+
+type ConsumerSpec struct {
+	// ClusterName is the name of the NatsCluster the stream belongs to.
+	ClusterName string `json:"clusterName"`
+	// AccountName is the name of the NatsAccount owning the stream, which
+	// must be set if the cluster has accounts enabled.
+	AccountName string `json:"accountName,omitempty"`
+	// StreamName is the name of the JetStream stream consumed.
+	StreamName string `json:"streamName"`
+
+	// DurableName is the name of the consumer.
+	// If it's not set by user, the default is the name of the NatsConsumer.
+	DurableName string `json:"durableName,omitempty"`
+
+	// DeliverPolicy is "all", "last" or "new".
+	// If it's not set by user, the default is "all".
+	DeliverPolicy string `json:"deliverPolicy,omitempty"`
+
+	// AckPolicy is "explicit", "all" or "none".
+	// If it's not set by user, the default is "explicit".
+	AckPolicy string `json:"ackPolicy,omitempty"`
+
+	// FilterSubject restricts the messages consumed to a subject.
+	FilterSubject string `json:"filterSubject,omitempty"`
+	// MaxDeliver is how many times a message is delivered. Unlimited if not set.
+	MaxDeliver int `json:"maxDeliver,omitempty"`
+	// AckWait is how long the server waits for an ack, e.g. "30s".
+	AckWait string `json:"ackWait,omitempty"`
+}
+
+type ConsumerStatus struct {
+	// Ready tells whether the consumer matches its spec.
+	Ready bool `json:"ready"`
+	// Reason explains why the consumer is not ready.
+	Reason string `json:"reason,omitempty"`
+
+	// NumPending is the number of messages not delivered yet, the lag of
+	// the consumer.
+	NumPending     uint64 `json:"numPending"`
+	NumAckPending  int    `json:"numAckPending"`
+	NumRedelivered int    `json:"numRedelivered"`
+}
+
+// DurableName returns the name of the JetStream consumer.
+func (c *NatsConsumer) DurableName() string {
+	if len(c.Spec.DurableName) != 0 {
+		return c.Spec.DurableName
+	}
+	return c.Name
+}
+
+// Validate returns an error if the consumer spec is invalid.
+func (c *NatsConsumer) Validate() error {
+	cs := &c.Spec
+	if len(cs.ClusterName) == 0 {
+		return errors.New("clusterName must be set")
+	}
+	if err := validateJetStreamName(cs.StreamName); err != nil {
+		return fmt.Errorf("streamName: %v", err)
+	}
+	if err := validateJetStreamName(c.DurableName()); err != nil {
+		return err
+	}
+	switch cs.DeliverPolicy {
+	case "", DeliverAll, DeliverLast, DeliverNew:
+	default:
+		return fmt.Errorf("unknown deliver policy %q", cs.DeliverPolicy)
+	}
+	switch cs.AckPolicy {
+	case "", AckExplicit, AckAll, AckNone:
+	default:
+		return fmt.Errorf("unknown ack policy %q", cs.AckPolicy)
+	}
+	if cs.MaxDeliver < 0 {
+		return errors.New("maxDeliver must not be negative")
+	}
+	if len(cs.AckWait) != 0 {
+		if _, err := time.ParseDuration(cs.AckWait); err != nil {
+			return fmt.Errorf("ackWait: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateJetStreamName checks a stream or consumer name can be used in
+// the subjects of the JetStream API.
+func validateJetStreamName(name string) error {
+	if len(name) == 0 {
+		return errors.New("name must be set")
+	}
+	if strings.ContainsAny(name, " \t\r\n.*>") {
+		return fmt.Errorf("invalid name %q: must not contain whitespace, '.', '*' or '>'", name)
+	}
+	return nil
+}
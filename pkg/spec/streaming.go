@@ -0,0 +1,82 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StoreType is the kind of store a NATS Streaming server keeps messages in.
+type StoreType string
+
+const (
+	StoreTypeMemory StoreType = "MEMORY"
+	StoreTypeFile   StoreType = "FILE"
+)
+
+// StreamingPolicy defines the NATS Streaming server deployed on top of the
+// NATS cluster. It connects to the cluster as a client through the client
+// service.
+type StreamingPolicy struct {
+	// ClusterID is the ID streaming clients connect with.
+	// If it's not set by user, the default is the name of the NatsCluster.
+	ClusterID string `json:"clusterID,omitempty"`
+
+	// Version is the version of the NATS Streaming server.
+	// If it's not set by user, the default is the operator's default version.
+	Version string `json:"version,omitempty"`
+
+	// StoreType selects where messages are stored.
+	// If it's not set by user, the default is "MEMORY".
+	StoreType StoreType `json:"storeType,omitempty"`
+
+	// Limits are the channel limits of the server. Limits which are not
+	// set by user take the server defaults.
+	Limits *ChannelLimits `json:"limits,omitempty"`
+}
+
+// ChannelLimits bounds the channels of a NATS Streaming server.
+type ChannelLimits struct {
+	MaxChannels      int   `json:"maxChannels,omitempty"`
+	MaxSubscriptions int   `json:"maxSubscriptions,omitempty"`
+	MaxMsgs          int   `json:"maxMsgs,omitempty"`
+	MaxBytes         int64 `json:"maxBytes,omitempty"`
+	// MaxAge is how long messages are kept, e.g. "24h".
+	MaxAge string `json:"maxAge,omitempty"`
+}
+
+func (p *StreamingPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.StoreType {
+	case "", StoreTypeMemory, StoreTypeFile:
+	default:
+		return fmt.Errorf("unknown streaming store type %q", p.StoreType)
+	}
+	if l := p.Limits; l != nil {
+		if l.MaxChannels < 0 || l.MaxSubscriptions < 0 || l.MaxMsgs < 0 || l.MaxBytes < 0 {
+			return errors.New("streaming.limits: values must not be negative")
+		}
+		if len(l.MaxAge) != 0 {
+			if _, err := time.ParseDuration(l.MaxAge); err != nil {
+				return fmt.Errorf("streaming.limits.maxAge: %v", err)
+			}
+		}
+	}
+	return nil
+}
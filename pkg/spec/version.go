@@ -0,0 +1,95 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spec
+
+import (
+	"fmt"
+
+	"github.com/blang/semver"
+)
+
+// VersionPolicy restricts the version changes accepted by the operator.
+type VersionPolicy struct {
+	// AllowDowngrade allows changing the version to an older one.
+	AllowDowngrade bool `json:"allowDowngrade,omitempty"`
+
+	// MaxMajorJump is the largest increase of the major version allowed
+	// by a single upgrade. If it's not set by user, the default is 1.
+	// A negative value allows any increase.
+	MaxMajorJump int `json:"maxMajorJump,omitempty"`
+
+	// MaxMinorJump is the largest increase of the minor version allowed
+	// by a single upgrade within a major version. If it's not set by user,
+	// any increase is allowed.
+	MaxMinorJump int `json:"maxMinorJump,omitempty"`
+
+	// RequiredVersions are versions the cluster must have been upgraded
+	// to before being upgraded past them.
+	RequiredVersions []string `json:"requiredVersions,omitempty"`
+}
+
+func (p *VersionPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, v := range p.RequiredVersions {
+		if _, err := semver.Parse(v); err != nil {
+			return fmt.Errorf("versionPolicy.requiredVersions: invalid version %q: %v", v, err)
+		}
+	}
+	return nil
+}
+
+// CheckVersionChange returns an error if the policy forbids changing the
+// version of a cluster from one version to the other. Both versions must
+// be valid semantic versions.
+func (p *VersionPolicy) CheckVersionChange(from, to string) error {
+	if p == nil {
+		p = &VersionPolicy{}
+	}
+	fv, err := semver.Parse(from)
+	if err != nil {
+		return fmt.Errorf("invalid current version %q: %v", from, err)
+	}
+	tv, err := semver.Parse(to)
+	if err != nil {
+		return fmt.Errorf("invalid version %q: %v", to, err)
+	}
+
+	if tv.LT(fv) {
+		if !p.AllowDowngrade {
+			return fmt.Errorf("downgrade from %s to %s is not allowed", fv, tv)
+		}
+		return nil
+	}
+
+	maxMajor := p.MaxMajorJump
+	if maxMajor == 0 {
+		maxMajor = 1
+	}
+	if maxMajor > 0 && tv.Major-fv.Major > uint64(maxMajor) {
+		return fmt.Errorf("upgrade from %s to %s skips major versions, at most %d allowed", fv, tv, maxMajor)
+	}
+	if p.MaxMinorJump > 0 && tv.Major == fv.Major && tv.Minor-fv.Minor > uint64(p.MaxMinorJump) {
+		return fmt.Errorf("upgrade from %s to %s skips minor versions, at most %d allowed", fv, tv, p.MaxMinorJump)
+	}
+	for _, r := range p.RequiredVersions {
+		rv := semver.MustParse(r)
+		if fv.LT(rv) && tv.GT(rv) {
+			return fmt.Errorf("upgrade from %s to %s must go through %s first", fv, tv, rv)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// ListAccounts retrieves the NatsAccount objects of the namespace.
+func ListAccounts(restcli *restclient.RESTClient, ns string) (*spec.NatsAccountList, error) {
+	list := &spec.NatsAccountList{}
+	if err := listTPRObjects(restcli, ns, "natsaccounts", list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UpdateAccountTPRObject replaces the NatsAccount object, e.g. to update its status.
+func UpdateAccountTPRObject(restcli *restclient.RESTClient, ns string, a *spec.NatsAccount) error {
+	return updateTPRObject(restcli, ns, "natsaccounts", a.Name, a)
+}
+
+// ListUsers retrieves the NatsUser objects of the namespace.
+func ListUsers(restcli *restclient.RESTClient, ns string) (*spec.NatsUserList, error) {
+	list := &spec.NatsUserList{}
+	if err := listTPRObjects(restcli, ns, "natsusers", list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UpdateUserTPRObject replaces the NatsUser object, e.g. to update its status.
+func UpdateUserTPRObject(restcli *restclient.RESTClient, ns string, u *spec.NatsUser) error {
+	return updateTPRObject(restcli, ns, "natsusers", u.Name, u)
+}
+
+// OperatorSecretName returns the name of the secret holding the operator
+// and system account keys of a cluster.
+func OperatorSecretName(clusterName string) string {
+	return clusterName + "-operator-keys"
+}
+
+// AuthCalloutSecretName returns the name of the secret holding the keys of
+// the auth callout account and service of a cluster.
+func AuthCalloutSecretName(clusterName string) string {
+	return clusterName + "-auth-callout-keys"
+}
+
+// SentinelSecretName returns the name of the secret holding the sentinel
+// credentials clients authenticating with their service account token
+// connect to a cluster with.
+func SentinelSecretName(clusterName string) string {
+	return clusterName + "-nats-sentinel"
+}
+
+// AccountsConfigMapName returns the name of the config map holding the
+// account JWTs the servers of a cluster preload with the memory resolver.
+func AccountsConfigMapName(clusterName string) string {
+	return clusterName + "-nats-accounts"
+}
+
+// AccountSecretName returns the name of the secret holding the key of the
+// account of a NatsAccount.
+func AccountSecretName(accountName string) string {
+	return accountName + "-nats-account"
+}
+
+// ApplySecret creates the secret, or replaces it if it exists.
+func ApplySecret(kclient *unversioned.Client, ns string, secret *api.Secret) error {
+	_, err := kclient.Secrets(ns).Update(secret)
+	if IsKubernetesResourceNotFoundError(err) {
+		_, err = kclient.Secrets(ns).Create(secret)
+	}
+	return err
+}
+
+// DeleteSecret deletes a secret, if it exists.
+func DeleteSecret(kclient *unversioned.Client, ns, name string) error {
+	err := kclient.Secrets(ns).Delete(name)
+	if err != nil && !IsKubernetesResourceNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// ListServiceRoles retrieves the NatsServiceRole objects of the namespace.
+func ListServiceRoles(restcli *restclient.RESTClient, ns string) (*spec.NatsServiceRoleList, error) {
+	list := &spec.NatsServiceRoleList{}
+	if err := listTPRObjects(restcli, ns, "natsserviceroles", list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ListBindings retrieves the NatsBinding objects of the namespace.
+func ListBindings(restcli *restclient.RESTClient, ns string) (*spec.NatsBindingList, error) {
+	list := &spec.NatsBindingList{}
+	if err := listTPRObjects(restcli, ns, "natsbindings", list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UpdateBindingTPRObject replaces the NatsBinding object, e.g. to update its status.
+func UpdateBindingTPRObject(restcli *restclient.RESTClient, ns string, b *spec.NatsBinding) error {
+	return updateTPRObject(restcli, ns, "natsbindings", b.Name, b)
+}
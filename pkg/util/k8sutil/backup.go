@@ -0,0 +1,184 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/restclient"
+)
+
+const (
+	s3AccessKeySecretKey = "accessKey"
+	s3SecretKeySecretKey = "secretKey"
+
+	snapshotAnnotationKey = "nats.io/snapshot"
+
+	// mcScript registers the object store as the "target" host of the
+	// MinIO client from the environment of the pod, then runs the client
+	// with the arguments of the container, which are never interpreted by
+	// the shell.
+	mcScript = `mc config host add target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" && exec mc "$@"`
+)
+
+// ListBackups retrieves the NatsBackup objects of the namespace.
+func ListBackups(restcli *restclient.RESTClient, ns string) (*spec.NatsBackupList, error) {
+	b, err := restcli.Get().AbsPath(fmt.Sprintf("/apis/nats.io/v1/namespaces/%s/natsbackups", ns)).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := &spec.NatsBackupList{}
+	if err := json.Unmarshal(b, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetBackupTPRObject retrieves the NatsBackup object with the given name.
+func GetBackupTPRObject(restcli *restclient.RESTClient, ns, name string) (*spec.NatsBackup, error) {
+	b, err := restcli.Get().AbsPath(backupTPRPath(ns, name)).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	backup := &spec.NatsBackup{}
+	if err := json.Unmarshal(b, backup); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// UpdateBackupTPRObject replaces the NatsBackup object, e.g. to update its status.
+func UpdateBackupTPRObject(restcli *restclient.RESTClient, ns string, backup *spec.NatsBackup) (*spec.NatsBackup, error) {
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	b, err := restcli.Put().AbsPath(backupTPRPath(ns, backup.Name)).Body(data).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	updated := &spec.NatsBackup{}
+	if err := json.Unmarshal(b, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func backupTPRPath(ns, name string) string {
+	return fmt.Sprintf("/apis/nats.io/v1/namespaces/%s/natsbackups/%s", ns, name)
+}
+
+// MakeBackupPod returns a pod copying the NATS Streaming file store of a
+// cluster into a snapshot. The pod runs on the node of the streaming server,
+// so that it can mount its volume along with the server.
+func MakeBackupPod(backup *spec.NatsBackup, snapshot, nodeName string) *api.Pod {
+	s3 := backup.Spec.S3
+	pod := makeObjectStorePod(snapshot, s3, mcArgs(s3, "mirror", streamingStoreDir, snapshotURL(s3, snapshot)))
+	pod.Labels["app"] = "nats-backup"
+	pod.Labels["nats_backup"] = backup.Name
+	pod.Spec.NodeName = nodeName
+	pod = podWithVolumeClaim(pod, StreamingPVCName(backup.Spec.ClusterName), streamingStoreDir)
+	pod.Spec.Containers[0].VolumeMounts[0].ReadOnly = true
+	return pod
+}
+
+// MakePruneSnapshotPod returns a pod deleting a snapshot.
+func MakePruneSnapshotPod(backup *spec.NatsBackup, snapshot string) *api.Pod {
+	s3 := backup.Spec.S3
+	pod := makeObjectStorePod(snapshot+"-prune", s3, mcArgs(s3, "rm", "--recursive", "--force", snapshotURL(s3, snapshot)))
+	pod.Labels["app"] = "nats-backup"
+	pod.Labels["nats_backup"] = backup.Name
+	return pod
+}
+
+// RestorePodName returns the name of the pod seeding the NATS Streaming
+// file store of a cluster.
+func RestorePodName(clusterName string) string {
+	return clusterName + "-restore"
+}
+
+// MakeRestorePod returns a pod copying a snapshot into the NATS Streaming
+// file store of a cluster.
+func MakeRestorePod(clusterName string, bs *spec.BackupSpec, snapshot string) *api.Pod {
+	pod := makeObjectStorePod(RestorePodName(clusterName), bs.S3, mcArgs(bs.S3, "mirror", snapshotURL(bs.S3, snapshot), streamingStoreDir))
+	pod.Labels["app"] = "nats-restore"
+	pod.Labels["nats_cluster"] = clusterName
+	pod.Annotations = map[string]string{snapshotAnnotationKey: snapshot}
+	return podWithVolumeClaim(pod, StreamingPVCName(clusterName), streamingStoreDir)
+}
+
+// GetRestoredSnapshot returns the snapshot a restore pod copies.
+func GetRestoredSnapshot(pod *api.Pod) string {
+	return pod.Annotations[snapshotAnnotationKey]
+}
+
+func makeObjectStorePod(name string, s3 *spec.S3Target, args []string) *api.Pod {
+	secretEnv := func(env, key string) api.EnvVar {
+		return api.EnvVar{
+			Name: env,
+			ValueFrom: &api.EnvVarSource{
+				SecretKeyRef: &api.SecretKeySelector{
+					LocalObjectReference: api.LocalObjectReference{Name: s3.CredentialsSecret},
+					Key:                  key,
+				},
+			},
+		}
+	}
+	return &api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{},
+		},
+		Spec: api.PodSpec{
+			Containers: []api.Container{
+				{
+					Name:            "mc",
+					Image:           constants.MinioClientImage,
+					ImagePullPolicy: api.PullIfNotPresent,
+					Command:         []string{"/bin/sh", "-c", mcScript, "mc"},
+					Args:            args,
+					Env: []api.EnvVar{
+						{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+						secretEnv("S3_ACCESS_KEY", s3AccessKeySecretKey),
+						secretEnv("S3_SECRET_KEY", s3SecretKeySecretKey),
+					},
+				},
+			},
+			RestartPolicy: api.RestartPolicyNever,
+		},
+	}
+}
+
+// mcArgs returns the arguments of the MinIO client running the given
+// command.
+func mcArgs(s3 *spec.S3Target, command string, args ...string) []string {
+	flags := []string{command, "--quiet"}
+	if s3.Insecure {
+		flags = append(flags, "--insecure")
+	}
+	return append(flags, args...)
+}
+
+// snapshotURL returns the location of a snapshot for the MinIO client. The
+// bucket, prefix and snapshot names are validated not to escape the bucket.
+func snapshotURL(s3 *spec.S3Target, snapshot string) string {
+	return "target/" + path.Join(s3.Bucket, s3.Prefix, snapshot)
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	configHashAnnotationKey   = "nats.io/config-hash"
+	accountsHashAnnotationKey = "nats.io/accounts-hash"
+
+	configVolumeName = "nats-config"
+	configDir        = "/etc/nats-config"
+	configFileName   = "nats.conf"
+	authFileName     = "auth.conf"
+
+	defaultJetStreamStoreDir = "jetstream"
+	accountResolverDir       = "jwt"
+)
+
+// ServerConfigMapName returns the name of the config map holding the given
+// configuration file of the NATS servers of a cluster. Each configuration
+// has its own config map, so that the file of running servers never
+// changes under them.
+func ServerConfigMapName(clusterName, conf string) string {
+	return fmt.Sprintf("%s-config-%s", clusterName, configHash(conf))
+}
+
+func configHash(conf string) string {
+	h := fnv.New32a()
+	h.Write([]byte(conf))
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+// GetServerConfigMapName returns the name of the config map the NATS server
+// of a pod loads its configuration file from, if any.
+func GetServerConfigMapName(pod *api.Pod) string {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == configVolumeName && v.ConfigMap != nil {
+			return v.ConfigMap.Name
+		}
+	}
+	return ""
+}
+
+func serverConfigListOpt(clusterName string) api.ListOptions {
+	return api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(serverConfigLabels(clusterName)),
+	}
+}
+
+func serverConfigLabels(clusterName string) map[string]string {
+	return map[string]string{
+		"app":          "nats-config",
+		"nats_cluster": clusterName,
+	}
+}
+
+// MakeServerConfig renders the settings of the cluster spec which have no
+// command line flag into a NATS server configuration file. It returns an
+// empty string if there are none.
+func MakeServerConfig(cs *spec.ClusterSpec) string {
+	var b bytes.Buffer
+	if js := cs.JetStream; js != nil {
+		storeDir := js.StoreDir
+		if len(storeDir) == 0 {
+			storeDir = defaultJetStreamStoreDir
+		}
+		b.WriteString("jetstream {\n")
+		fmt.Fprintf(&b, "  store_dir: %q\n", path.Join(natsDataDir, storeDir))
+		if q, err := resource.ParseQuantity(js.MaxMemoryStore); err == nil {
+			fmt.Fprintf(&b, "  max_memory_store: %d\n", q.Value())
+		}
+		if q, err := resource.ParseQuantity(js.MaxFileStore); err == nil {
+			fmt.Fprintf(&b, "  max_file_store: %d\n", q.Value())
+		}
+		if len(js.Domain) != 0 {
+			fmt.Fprintf(&b, "  domain: %q\n", js.Domain)
+		}
+		b.WriteString("}\n")
+	}
+	if cs.Accounts != nil {
+		// the operator and system account, which are generated by the
+		// operator, are in the auth file
+		fmt.Fprintf(&b, "include %q\n", authFileName)
+		if cs.Accounts.MemoryResolver() {
+			// the account JWTs are preloaded from the auth file
+			b.WriteString("resolver: MEMORY\n")
+		} else {
+			b.WriteString("resolver {\n")
+			b.WriteString("  type: full\n")
+			fmt.Fprintf(&b, "  dir: %q\n", path.Join(natsDataDir, accountResolverDir))
+			b.WriteString("  allow_delete: false\n")
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+// ApplyServerConfig creates the config map holding the configuration file
+// of the NATS servers, if the cluster spec needs one, along with the auth
+// file it includes, if any. An existing one is updated with the auth file.
+func ApplyServerConfig(kclient *unversioned.Client, ns, clusterName string, cs *spec.ClusterSpec, authConf string) error {
+	conf := MakeServerConfig(cs)
+	if len(conf) == 0 {
+		return nil
+	}
+	cm := &api.ConfigMap{
+		ObjectMeta: api.ObjectMeta{
+			Name:   ServerConfigMapName(clusterName, conf),
+			Labels: serverConfigLabels(clusterName),
+		},
+		Data: map[string]string{configFileName: conf},
+	}
+	if len(authConf) != 0 {
+		cm.Data[authFileName] = authConf
+	}
+	_, err := kclient.ConfigMaps(ns).Update(cm)
+	if IsKubernetesResourceNotFoundError(err) {
+		_, err = kclient.ConfigMaps(ns).Create(cm)
+		if IsKubernetesResourceAlreadyExistError(err) {
+			// created concurrently for another peer
+			return nil
+		}
+	}
+	return err
+}
+
+// DeleteServerConfigs deletes the config maps of the NATS servers of a
+// cluster, but the ones in use.
+func DeleteServerConfigs(kclient *unversioned.Client, ns, clusterName string, inUse map[string]bool) error {
+	list, err := kclient.ConfigMaps(ns).List(serverConfigListOpt(clusterName))
+	if err != nil {
+		return err
+	}
+	// older operators made a single config map shared by all the servers
+	names := []string{clusterName + "-config"}
+	for _, cm := range list.Items {
+		names = append(names, cm.Name)
+	}
+	for _, name := range names {
+		if inUse[name] {
+			continue
+		}
+		if err := kclient.ConfigMaps(ns).Delete(name); err != nil && !IsKubernetesResourceNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// podWithServerConfig makes the NATS server of the pod load its
+// configuration file. The pod is annotated with a hash of the file, so
+// that configuration changes are rolled out like other pod changes.
+func podWithServerConfig(pod *api.Pod, clusterName, conf string) *api.Pod {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, api.Volume{
+		Name: configVolumeName,
+		VolumeSource: api.VolumeSource{
+			ConfigMap: &api.ConfigMapVolumeSource{
+				LocalObjectReference: api.LocalObjectReference{Name: ServerConfigMapName(clusterName, conf)},
+			},
+		},
+	})
+	c := &pod.Spec.Containers[0]
+	c.VolumeMounts = append(c.VolumeMounts, api.VolumeMount{Name: configVolumeName, MountPath: configDir, ReadOnly: true})
+	c.Args = append(c.Args, "--config="+path.Join(configDir, configFileName))
+
+	pod.Annotations[configHashAnnotationKey] = configHash(conf)
+	return pod
+}
+
+// AccountsHash identifies the account JWTs the servers preload with the
+// memory resolver, by account public key.
+func AccountsHash(preloads map[string]string) string {
+	keys := make([]string, 0, len(preloads))
+	for k := range preloads {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New32a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s:%s\n", k, preloads[k])
+	}
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+// GetAccountsHash returns the hash of the account JWTs the NATS server of a
+// pod preloaded, if any.
+func GetAccountsHash(pod *api.Pod) string {
+	return pod.Annotations[accountsHashAnnotationKey]
+}
+
+func SetAccountsHash(pod *api.Pod, hash string) {
+	pod.Annotations[accountsHashAnnotationKey] = hash
+}
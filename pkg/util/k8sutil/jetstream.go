@@ -0,0 +1,86 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/client/restclient"
+)
+
+// ClientURL returns the URL clients of a NATS cluster connect to.
+func ClientURL(clusterName string) string {
+	return fmt.Sprintf("nats://%s:%d", clusterName, constants.ClientPort)
+}
+
+// ListStreams retrieves the NatsStream objects of the namespace.
+func ListStreams(restcli *restclient.RESTClient, ns string) (*spec.NatsStreamList, error) {
+	list := &spec.NatsStreamList{}
+	if err := listTPRObjects(restcli, ns, "natsstreams", list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UpdateStreamTPRObject replaces the NatsStream object, e.g. to update its status.
+func UpdateStreamTPRObject(restcli *restclient.RESTClient, ns string, s *spec.NatsStream) error {
+	return updateTPRObject(restcli, ns, "natsstreams", s.Name, s)
+}
+
+// ListConsumers retrieves the NatsConsumer objects of the namespace.
+func ListConsumers(restcli *restclient.RESTClient, ns string) (*spec.NatsConsumerList, error) {
+	list := &spec.NatsConsumerList{}
+	if err := listTPRObjects(restcli, ns, "natsconsumers", list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UpdateConsumerTPRObject replaces the NatsConsumer object, e.g. to update its status.
+func UpdateConsumerTPRObject(restcli *restclient.RESTClient, ns string, c *spec.NatsConsumer) error {
+	return updateTPRObject(restcli, ns, "natsconsumers", c.Name, c)
+}
+
+// ListClusterTPRObjects retrieves the NatsCluster objects of the namespace.
+func ListClusterTPRObjects(restcli *restclient.RESTClient, ns string) ([]spec.NatsCluster, error) {
+	list := struct {
+		Items []spec.NatsCluster `json:"items"`
+	}{}
+	if err := listTPRObjects(restcli, ns, "natsclusters", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listTPRObjects(restcli *restclient.RESTClient, ns, resource string, list interface{}) error {
+	b, err := restcli.Get().AbsPath(fmt.Sprintf("/apis/nats.io/v1/namespaces/%s/%s", ns, resource)).DoRaw()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, list)
+}
+
+func updateTPRObject(restcli *restclient.RESTClient, ns, resource, name string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = restcli.Put().AbsPath(fmt.Sprintf("/apis/nats.io/v1/namespaces/%s/%s/%s", ns, resource, name)).Body(data).DoRaw()
+	return err
+}
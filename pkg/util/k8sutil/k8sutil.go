@@ -15,9 +15,14 @@
 package k8sutil
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fakod/nats-operator/pkg/constants"
@@ -35,7 +40,8 @@ import (
 )
 
 const (
-	versionAnnotationKey = "nats.version"
+	versionAnnotationKey      = "nats.version"
+	templateHashAnnotationKey = "nats.pod-template-hash"
 )
 
 func GetNATSVersion(pod *api.Pod) string {
@@ -46,6 +52,48 @@ func SetNATSVersion(pod *api.Pod, version string) {
 	pod.Annotations[versionAnnotationKey] = version
 }
 
+// GetPodTemplateHash returns the hash of the pod template a pod was made from.
+func GetPodTemplateHash(pod *api.Pod) string {
+	return pod.Annotations[templateHashAnnotationKey]
+}
+
+// PodTemplateHash returns the hash of the NATS pod template derived from
+// the cluster specification. It is the same for all the members. The routes
+// are left out: they only depend on the peers running when a pod is made,
+// and the running peers learn about the new ones.
+func PodTemplateHash(clusterName string, cs *spec.ClusterSpec) string {
+	return hashPod(makePod(clusterName, 0, nil, cs))
+}
+
+func hashPod(pod *api.Pod) string {
+	b, err := json.Marshal(pod)
+	if err != nil {
+		panic("Failed to marshal pod template: " + err.Error())
+	}
+	h := fnv.New32a()
+	h.Write(b)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// MemberRoute returns the route URL of the NATS peer with the given member
+// index.
+func MemberRoute(clusterName string, index int) string {
+	return fmt.Sprintf("nats://%s.%s:%d", MemberName(clusterName, index), MgmtServiceName(clusterName), constants.ClusterPort)
+}
+
+// PodRoute returns the route URL of the NATS peer running in pod. A pod made
+// before members had identities has no DNS record and is routed to by IP,
+// an empty string is returned if it has none yet.
+func PodRoute(clusterName string, pod *api.Pod) string {
+	if index := GetMemberIndex(pod); index >= 0 {
+		return MemberRoute(clusterName, index)
+	}
+	if len(pod.Status.PodIP) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("nats://%s:%d", pod.Status.PodIP, constants.ClusterPort)
+}
+
 func GetPodNames(pods []*api.Pod) []string {
 	res := []string{}
 	for _, p := range pods {
@@ -63,14 +111,28 @@ func PodWithNodeSelector(p *api.Pod, ns map[string]string) *api.Pod {
 	return p
 }
 
-// CreateMgmtService creates an headless service for NATS management purposes.
-func CreateMgmtService(kclient *unversioned.Client, clusterName, ns string) (*api.Service, error) {
+// ApplyMgmtService creates the headless service for NATS management
+// purposes, or updates the existing one, e.g. made by an older operator
+// without the DNS records of the peers.
+func ApplyMgmtService(kclient *unversioned.Client, clusterName, ns string) (*api.Service, error) {
 	svc := makeMgmtServiceSpec(clusterName)
 	retSvc, err := kclient.Services(ns).Create(svc)
+	if err == nil || !IsKubernetesResourceAlreadyExistError(err) {
+		return retSvc, err
+	}
+	old, err := kclient.Services(ns).Get(svc.Name)
 	if err != nil {
 		return nil, err
 	}
-	return retSvc, nil
+	if reflect.DeepEqual(old.Labels, svc.Labels) && reflect.DeepEqual(old.Annotations, svc.Annotations) &&
+		reflect.DeepEqual(old.Spec.Ports, svc.Spec.Ports) && reflect.DeepEqual(old.Spec.Selector, svc.Spec.Selector) {
+		return old, nil
+	}
+	old.Labels = svc.Labels
+	old.Annotations = svc.Annotations
+	old.Spec.Ports = svc.Spec.Ports
+	old.Spec.Selector = svc.Spec.Selector
+	return kclient.Services(ns).Update(old)
 }
 
 // DeleteMgmtService deletes the headless service used for NATS management purposes.
@@ -121,6 +183,18 @@ func makeServiceSpec(clusterName string) *api.Service {
 	return svc
 }
 
+// MgmtServiceName returns the name of the headless service giving each
+// NATS peer of a cluster a DNS record.
+func MgmtServiceName(clusterName string) string {
+	return clusterName + "-mgmt"
+}
+
+// MemberName returns the name, and hostname, of the NATS peer with the
+// given member index.
+func MemberName(clusterName string, index int) string {
+	return fmt.Sprintf("%s-%d", clusterName, index)
+}
+
 func makeMgmtServiceSpec(clusterName string) *api.Service {
 	labels := map[string]string{
 		"app":          "nats-mgmt",
@@ -128,8 +202,13 @@ func makeMgmtServiceSpec(clusterName string) *api.Service {
 	}
 	svc := &api.Service{
 		ObjectMeta: api.ObjectMeta{
-			Name:   clusterName + "-mgmt",
+			Name:   MgmtServiceName(clusterName),
 			Labels: labels,
+			Annotations: map[string]string{
+				// peers must resolve each other to form the route mesh
+				// before they are ready
+				"service.alpha.kubernetes.io/tolerate-unready-endpoints": "true",
+			},
 		},
 		Spec: api.ServiceSpec{
 			ClusterIP: api.ClusterIPNone,
@@ -147,96 +226,112 @@ func makeMgmtServiceSpec(clusterName string) *api.Service {
 					Protocol:   api.ProtocolTCP,
 				},
 			},
-			Selector: labels,
+			Selector: map[string]string{
+				"app":          "nats",
+				"nats_cluster": clusterName,
+			},
 		},
 	}
 	return svc
 }
 
-// CreateAndWaitPod creates a pod and waits for it to be healthy, or returns error otherwise.
-func CreateAndWaitPod(kclient *unversioned.Client, ns string, pod *api.Pod, timeout time.Duration) error {
+// CreateAndWaitPod creates a pod and waits for it to be running and ready, or returns error otherwise.
+func CreateAndWaitPod(kclient *unversioned.Client, ns string, pod *api.Pod, timeout time.Duration) (*api.Pod, error) {
 	// create pod
 	createdPod, err := kclient.Pods(ns).Create(pod)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// watch for pod to become healthy
+	// watch for pod to become ready
 	w, err := kclient.Pods(ns).Watch(api.SingleObject(api.ObjectMeta{Name: createdPod.Name}))
 	if err != nil {
-		return err
-	}
-	_, err = watch.Until(timeout, w, unversioned.PodRunning)
-
-	// TODO remove dead pod?
-	//if err != nil {
-	//	kclient.Pods(ns).Delete(pod.Name, &api.DeleteOptions{})
-	//}
-
-	return err
-}
-
-// UpdateAndWaitPod updates a pod and waits for it to be healthy, or returns error otherwise.
-func UpdateAndWaitPod(kclient *unversioned.Client, ns string, pod *api.Pod, timeout time.Duration) error {
-	// make sure pod exists
-	_, err := kclient.Pods(ns).Get(pod.Name)
-	if err != nil {
-		return err
-	}
-
-	// update pod
-	updatedPod, err := kclient.Pods(ns).Update(pod)
-	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// watch for pod to become healthy
-	w, err := kclient.Pods(ns).Watch(api.SingleObject(api.ObjectMeta{Name: updatedPod.Name}))
+	ev, err := watch.Until(timeout, w, unversioned.PodRunningAndReady)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = watch.Until(timeout, w, unversioned.PodRunning)
 
 	// TODO remove dead pod?
 	//if err != nil {
 	//	kclient.Pods(ns).Delete(pod.Name, &api.DeleteOptions{})
 	//}
 
-	return err
+	return ev.Object.(*api.Pod), nil
 }
 
-// MakePodSpec returns a NATS peer pod specification, based on the cluster specification.
-func MakePodSpec(clusterName string, cs *spec.ClusterSpec) *api.Pod {
-	// TODO add TLS, auth support, debug and tracing
+// MakePodSpec returns the pod specification of the NATS peer with the given
+// member index, routing to the given peers, based on the cluster specification.
+func MakePodSpec(clusterName string, index int, routes []string, cs *spec.ClusterSpec) *api.Pod {
+	pod := makePod(clusterName, index, routes, cs)
+	pod.Annotations[templateHashAnnotationKey] = PodTemplateHash(clusterName, cs)
+	return pod
+}
+
+func makePod(clusterName string, index int, routes []string, cs *spec.ClusterSpec) *api.Pod {
+	// TODO add debug and tracing
 	args := []string{
 		fmt.Sprintf("--cluster=nats://0.0.0.0:%d", constants.ClusterPort),
 		fmt.Sprintf("--http_port=%d", constants.MonitoringPort),
-		fmt.Sprintf("--routes=nats://%s:%d", clusterName+"-mgmt", constants.ClusterPort),
+	}
+	if len(routes) != 0 {
+		args = append(args, "--routes="+strings.Join(routes, ","))
 	}
 
+	name := MemberName(clusterName, index)
 	pod := &api.Pod{
 		ObjectMeta: api.ObjectMeta{
-			GenerateName: clusterName + "-",
+			Name: name,
 			Labels: map[string]string{
 				"app":          "nats",
 				"nats_cluster": clusterName,
+				memberLabelKey: strconv.Itoa(index),
 			},
 			Annotations: map[string]string{},
 		},
 		Spec: api.PodSpec{
 			Containers: []api.Container{
-				natsPodContainer(args, cs.Version),
+				natsPodContainer(args, cs.Version, cs.Pod),
+				routeCheckContainer(routes, cs.Pod),
 			},
 			RestartPolicy: api.RestartPolicyNever,
-			// TODO use for TLS
-			//Volumes: []api.Volume{
-			//	{Name: "nats-tls", VolumeSource: api.VolumeSource{EmptyDir: &api.EmptyDirVolumeSource{}}},
-			//},
+			// <name>.<cluster>-mgmt resolves to the pod
+			Hostname:  name,
+			Subdomain: MgmtServiceName(clusterName),
 		},
 	}
 
 	SetNATSVersion(pod, cs.Version)
 
+	if cs.Storage != nil {
+		pod = podWithVolumeClaim(pod, MemberPVCName(clusterName, index), natsDataDir)
+	}
+
+	if conf := MakeServerConfig(cs); len(conf) != 0 {
+		pod = podWithServerConfig(pod, clusterName, conf)
+	}
+	if cs.TLS != nil {
+		pod = podWithTLS(pod, cs.TLS.ServerSecret)
+	}
+	if cs.JetStream != nil {
+		// JetStream identifies the servers and the cluster by name
+		c := &pod.Spec.Containers[0]
+		c.Args = append(c.Args, "--name="+name, "--cluster_name="+clusterName)
+	}
+
+	// give the server time to drain in lame duck mode
+	grace := int64(constants.DefaultDrainTimeoutSeconds)
+	if p := cs.Pod; p != nil {
+		if p.DrainTimeoutSeconds > 0 {
+			grace = int64(p.DrainTimeoutSeconds)
+		}
+		if p.TerminationGracePeriodSeconds != nil {
+			grace = *p.TerminationGracePeriodSeconds
+		}
+	}
+	pod.Spec.TerminationGracePeriodSeconds = &grace
+
 	if cs.AntiAffinity {
 		pod = podWithAntiAffinity(pod, clusterName)
 	}
@@ -248,6 +343,47 @@ func MakePodSpec(clusterName string, cs *spec.ClusterSpec) *api.Pod {
 	return pod
 }
 
+// GetPodLogs returns the last lines logged by a container of a pod.
+func GetPodLogs(kclient *unversioned.Client, ns, podName, container string, tailLines int) (string, error) {
+	b, err := kclient.RESTClient.Get().
+		Namespace(ns).
+		Resource("pods").
+		Name(podName).
+		SubResource("log").
+		Param("container", container).
+		Param("tailLines", strconv.Itoa(tailLines)).
+		DoRaw()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// CreateClusterEvent records an event about a NATS cluster.
+func CreateClusterEvent(kclient *unversioned.Client, ns, clusterName, eventType, reason, message string) error {
+	now := unversionedAPI.Now()
+	ev := &api.Event{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName: clusterName + "-",
+		},
+		InvolvedObject: api.ObjectReference{
+			APIVersion: "nats.io/v1",
+			Kind:       "NatsCluster",
+			Namespace:  ns,
+			Name:       clusterName,
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         api.EventSource{Component: "nats-operator"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	_, err := kclient.Events(ns).Create(ev)
+	return err
+}
+
 func MustGetInClusterMasterHost() string {
 	cfg, err := restclient.InClusterConfig()
 	if err != nil {
@@ -318,6 +454,40 @@ func WatchClusters(host, ns string, httpClient *http.Client, resourceVersion str
 		host, ns, resourceVersion))
 }
 
+// GetClusterTPRObject retrieves the NatsCluster object with the given name.
+func GetClusterTPRObject(restcli *restclient.RESTClient, ns, name string) (*spec.NatsCluster, error) {
+	b, err := restcli.Get().AbsPath(clusterTPRPath(ns, name)).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	cl := &spec.NatsCluster{}
+	if err := json.Unmarshal(b, cl); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// UpdateClusterTPRObject replaces the NatsCluster object, e.g. to update its status.
+func UpdateClusterTPRObject(restcli *restclient.RESTClient, ns string, cl *spec.NatsCluster) (*spec.NatsCluster, error) {
+	data, err := json.Marshal(cl)
+	if err != nil {
+		return nil, err
+	}
+	b, err := restcli.Put().AbsPath(clusterTPRPath(ns, cl.Name)).Body(data).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	updated := &spec.NatsCluster{}
+	if err := json.Unmarshal(b, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func clusterTPRPath(ns, name string) string {
+	return fmt.Sprintf("/apis/nats.io/v1/namespaces/%s/natsclusters/%s", ns, name)
+}
+
 func WaitTPRReady(httpClient *http.Client, interval, timeout time.Duration, host, ns string) error {
 	return wait.Poll(interval, timeout, func() (bool, error) {
 		resp, err := ListClusters(host, ns, httpClient)
@@ -16,8 +16,12 @@ package k8sutil
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 
+	"github.com/blang/semver"
 	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
 
 	"k8s.io/kubernetes/pkg/api"
 	unversionedAPI "k8s.io/kubernetes/pkg/api/unversioned"
@@ -25,11 +29,11 @@ import (
 )
 
 // natsPodContainer returns a NATS server pod container spec.
-func natsPodContainer(args []string, version string) api.Container {
+func natsPodContainer(args []string, version string, policy *spec.PodPolicy) api.Container {
 	c := api.Container{
 		Name:            "nats",
 		Image:           MakeNATSImage(version),
-		ImagePullPolicy: api.PullAlways,
+		ImagePullPolicy: api.PullIfNotPresent,
 		Args:            args,
 		Ports: []api.ContainerPort{
 			{
@@ -62,15 +66,130 @@ func natsPodContainer(args []string, version string) api.Container {
 			// failed for 3 minutes
 			FailureThreshold: 3,
 		},
-		// TODO use for TLS
-		//VolumeMounts: []api.VolumeMount{
-		//	{Name: "nats-data", MountPath: rootDir},
-		//},
+		// a NATS pod is ready when it accepts client connections, and joined
+		// the route mesh, see routeCheckContainer.
+		ReadinessProbe: &api.Probe{
+			Handler: api.Handler{
+				TCPSocket: &api.TCPSocketAction{
+					Port: intstr.FromInt(constants.ClientPort),
+				},
+			},
+			InitialDelaySeconds: 2,
+			TimeoutSeconds:      5,
+			PeriodSeconds:       5,
+			FailureThreshold:    3,
+		},
+	}
+
+	if policy != nil {
+		applyProbePolicy(c.LivenessProbe, policy.LivenessProbe)
+		applyProbePolicy(c.ReadinessProbe, policy.ReadinessProbe)
+	}
+	// put the server in lame duck mode before it is terminated, so it
+	// stops accepting clients and migrates the connected ones to the
+	// other peers. A server in lame duck mode ignores SIGTERM and exits
+	// by itself once drained, or is killed when the grace period expires.
+	// Older servers just exit on SIGTERM, once drained by the operator.
+	if supportsLameDuck(version) {
+		c.Lifecycle = &api.Lifecycle{
+			PreStop: &api.Handler{
+				Exec: &api.ExecAction{
+					Command: []string{natsServerBinary(version), "--signal", "ldm=1"},
+				},
+			},
+		}
 	}
 
 	return c
 }
 
+// routeCheckScript succeeds when the NATS server of the pod has routes to
+// other peers, or was not given any peer to route to, e.g. as the first
+// member of a cluster.
+var routeCheckScript = fmt.Sprintf(`[ -z "$NATS_ROUTES" ] || wget -q -O - http://127.0.0.1:%d/routez | grep -q '"num_routes": *[1-9]'`, constants.MonitoringPort)
+
+// routeCheckLoop keeps the route check container running as long as the
+// NATS server of the pod does. The pod only fails once all its containers
+// terminated, so the container exits when the monitoring endpoint stopped
+// answering after the server came up.
+var routeCheckLoop = fmt.Sprintf(`trap 'exit 0' TERM; up=; down=0
+while sleep 5 & wait; do
+  if wget -q -O /dev/null http://127.0.0.1:%d/varz; then up=1; down=0
+  elif [ -n "$up" ]; then down=$((down+1)); [ $down -lt 3 ] || exit 0
+  fi
+done`, constants.MonitoringPort)
+
+// routeCheckContainer returns the container whose readiness tells whether
+// the NATS server of the pod joined the route mesh. A pod is only ready
+// once all its containers are, and the NATS image has no shell to check
+// the routes from.
+func routeCheckContainer(peerRoutes []string, policy *spec.PodPolicy) api.Container {
+	c := api.Container{
+		Name:            "route-check",
+		Image:           constants.RouteCheckImage,
+		ImagePullPolicy: api.PullIfNotPresent,
+		Command:         []string{"sh", "-c", routeCheckLoop},
+		Env: []api.EnvVar{
+			{Name: "NATS_ROUTES", Value: strings.Join(peerRoutes, ",")},
+		},
+		ReadinessProbe: &api.Probe{
+			Handler: api.Handler{
+				Exec: &api.ExecAction{
+					Command: []string{"sh", "-c", routeCheckScript},
+				},
+			},
+			InitialDelaySeconds: 2,
+			TimeoutSeconds:      5,
+			PeriodSeconds:       5,
+			FailureThreshold:    3,
+		},
+	}
+	if policy != nil {
+		applyProbePolicy(c.ReadinessProbe, policy.ReadinessProbe)
+	}
+	return c
+}
+
+// minLameDuckVersion is the first NATS version whose server can be
+// signaled to enter lame duck mode.
+var minLameDuckVersion = semver.MustParse("2.0.0")
+
+func supportsLameDuck(version string) bool {
+	v, err := semver.Parse(version)
+	return err == nil && v.GTE(minLameDuckVersion)
+}
+
+// natsServerBinary returns the path of the server binary in the NATS image
+// of the given version.
+func natsServerBinary(version string) string {
+	if strings.HasPrefix(version, "0.") || strings.HasPrefix(version, "1.") {
+		return "/gnatsd"
+	}
+	return "/nats-server"
+}
+
+// applyProbePolicy overrides the probe timings set by user.
+func applyProbePolicy(probe *api.Probe, p *spec.ProbePolicy) {
+	if p == nil {
+		return
+	}
+	if p.InitialDelaySeconds != 0 {
+		probe.InitialDelaySeconds = p.InitialDelaySeconds
+	}
+	if p.TimeoutSeconds != 0 {
+		probe.TimeoutSeconds = p.TimeoutSeconds
+	}
+	if p.PeriodSeconds != 0 {
+		probe.PeriodSeconds = p.PeriodSeconds
+	}
+	if p.SuccessThreshold != 0 {
+		probe.SuccessThreshold = p.SuccessThreshold
+	}
+	if p.FailureThreshold != 0 {
+		probe.FailureThreshold = p.FailureThreshold
+	}
+}
+
 // podWithAntiAffinity sets pod anti-affinity with the pods in the same NATS cluster
 func podWithAntiAffinity(pod *api.Pod, clusterName string) *api.Pod {
 	affinity := api.Affinity{
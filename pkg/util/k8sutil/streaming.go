@@ -0,0 +1,131 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"fmt"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const streamingStoreDir = "/data/stan"
+
+func MakeNATSStreamingImage(version string) string {
+	return fmt.Sprintf("nats-streaming:%v", version)
+}
+
+// StreamingPodTemplateHash returns the hash of the NATS Streaming pod
+// template derived from the cluster specification.
+func StreamingPodTemplateHash(clusterName string, cs *spec.ClusterSpec) string {
+	return hashPod(makeStreamingPod(clusterName, cs))
+}
+
+// MakeStreamingPodSpec returns a NATS Streaming server pod specification,
+// based on the cluster specification. The cluster spec must have a
+// streaming policy.
+func MakeStreamingPodSpec(clusterName string, cs *spec.ClusterSpec) *api.Pod {
+	pod := makeStreamingPod(clusterName, cs)
+	pod.Annotations[templateHashAnnotationKey] = StreamingPodTemplateHash(clusterName, cs)
+	return pod
+}
+
+func makeStreamingPod(clusterName string, cs *spec.ClusterSpec) *api.Pod {
+	sp := cs.Streaming
+	clusterID := sp.ClusterID
+	if len(clusterID) == 0 {
+		clusterID = clusterName
+	}
+	version := sp.Version
+	if len(version) == 0 {
+		version = constants.NatsStreamingVersion
+	}
+	storeType := sp.StoreType
+	if len(storeType) == 0 {
+		storeType = spec.StoreTypeMemory
+	}
+
+	args := []string{
+		fmt.Sprintf("--cluster_id=%s", clusterID),
+		"--nats_server=" + ClientURL(clusterName),
+		fmt.Sprintf("--store=%s", storeType),
+	}
+	if l := sp.Limits; l != nil {
+		if l.MaxChannels > 0 {
+			args = append(args, fmt.Sprintf("--max_channels=%d", l.MaxChannels))
+		}
+		if l.MaxSubscriptions > 0 {
+			args = append(args, fmt.Sprintf("--max_subs=%d", l.MaxSubscriptions))
+		}
+		if l.MaxMsgs > 0 {
+			args = append(args, fmt.Sprintf("--max_msgs=%d", l.MaxMsgs))
+		}
+		if l.MaxBytes > 0 {
+			args = append(args, fmt.Sprintf("--max_bytes=%d", l.MaxBytes))
+		}
+		if len(l.MaxAge) != 0 {
+			args = append(args, fmt.Sprintf("--max_age=%s", l.MaxAge))
+		}
+	}
+
+	container := api.Container{
+		Name:            "nats-streaming",
+		Image:           MakeNATSStreamingImage(version),
+		ImagePullPolicy: api.PullIfNotPresent,
+		Args:            args,
+	}
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName: clusterName + "-stan-",
+			Labels: map[string]string{
+				"app":          "nats-streaming",
+				"nats_cluster": clusterName,
+			},
+			Annotations: map[string]string{},
+		},
+		Spec: api.PodSpec{
+			RestartPolicy: api.RestartPolicyNever,
+		},
+	}
+
+	if storeType == spec.StoreTypeFile {
+		container.Args = append(container.Args, fmt.Sprintf("--dir=%s", streamingStoreDir))
+	}
+	pod.Spec.Containers = []api.Container{container}
+	switch {
+	case storeType == spec.StoreTypeFile && cs.Storage != nil:
+		pod = podWithVolumeClaim(pod, StreamingPVCName(clusterName), streamingStoreDir)
+	case storeType == spec.StoreTypeFile:
+		// the store does not survive the pod without persistent storage
+		pod = podWithEmptyDir(pod, streamingStoreDir)
+	}
+
+	if len(cs.NodeSelector) != 0 {
+		pod = PodWithNodeSelector(pod, cs.NodeSelector)
+	}
+	return pod
+}
+
+func StreamingPodListOpt(clusterName string) api.ListOptions {
+	return api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			"app":          "nats-streaming",
+			"nats_cluster": clusterName,
+		}),
+	}
+}
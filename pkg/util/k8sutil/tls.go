@@ -0,0 +1,74 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	tlsVolumeName = "nats-tls"
+	tlsDir        = "/etc/nats-tls"
+
+	tlsCertKey = "tls.crt"
+	tlsKeyKey  = "tls.key"
+	tlsCAKey   = "ca.crt"
+)
+
+// podWithTLS makes the NATS server of the pod require TLS on the client
+// port, with the certificate of the secret.
+func podWithTLS(pod *api.Pod, secretName string) *api.Pod {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, api.Volume{
+		Name: tlsVolumeName,
+		VolumeSource: api.VolumeSource{
+			Secret: &api.SecretVolumeSource{SecretName: secretName},
+		},
+	})
+	c := &pod.Spec.Containers[0]
+	c.VolumeMounts = append(c.VolumeMounts, api.VolumeMount{Name: tlsVolumeName, MountPath: tlsDir, ReadOnly: true})
+	c.Args = append(c.Args,
+		"--tls",
+		"--tlscert="+path.Join(tlsDir, tlsCertKey),
+		"--tlskey="+path.Join(tlsDir, tlsKeyKey),
+	)
+	return pod
+}
+
+// ClientTLSConfig returns the TLS configuration the operator connects to
+// the client port of a cluster with, which verifies the servers with the
+// CA certificate of their secret. It returns nil if the cluster does not
+// have TLS.
+func ClientTLSConfig(kclient *unversioned.Client, ns string, cs *spec.ClusterSpec) (*tls.Config, error) {
+	if cs.TLS == nil {
+		return nil, nil
+	}
+	secret, err := kclient.Secrets(ns).Get(cs.TLS.ServerSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TLS secret %q: %v", cs.TLS.ServerSecret, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[tlsCAKey]) {
+		return nil, fmt.Errorf("no CA certificate in TLS secret %q", cs.TLS.ServerSecret)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/fakod/nats-operator/pkg/spec"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/apis/storage"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	memberLabelKey = "nats_member"
+
+	storageClassAnnotationKey = "volume.beta.kubernetes.io/storage-class"
+
+	dataVolumeName = "nats-data"
+	natsDataDir    = "/data/nats"
+)
+
+// GetMemberIndex returns the index identifying the NATS server running in
+// a pod, or -1 if the pod has none.
+func GetMemberIndex(pod *api.Pod) int {
+	i, err := strconv.Atoi(pod.Labels[memberLabelKey])
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+// MemberPVCName returns the name of the volume claim of a NATS server.
+func MemberPVCName(clusterName string, index int) string {
+	return fmt.Sprintf("%s-data-%d", clusterName, index)
+}
+
+// StreamingPVCName returns the name of the volume claim of the NATS
+// Streaming server.
+func StreamingPVCName(clusterName string) string {
+	return clusterName + "-stan-data"
+}
+
+// CreatePVC creates a volume claim following the storage policy, unless it
+// already exists.
+func CreatePVC(kclient *unversioned.Client, ns, clusterName, name string, st *spec.StoragePolicy) error {
+	size, err := resource.ParseQuantity(st.Size)
+	if err != nil {
+		return err
+	}
+	pvc := &api.PersistentVolumeClaim{
+		ObjectMeta: api.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"app":          "nats",
+				"nats_cluster": clusterName,
+			},
+			Annotations: map[string]string{},
+		},
+		Spec: api.PersistentVolumeClaimSpec{
+			AccessModes: []api.PersistentVolumeAccessMode{api.ReadWriteOnce},
+			Resources: api.ResourceRequirements{
+				Requests: api.ResourceList{api.ResourceStorage: size},
+			},
+		},
+	}
+	if len(st.StorageClass) != 0 {
+		pvc.Annotations[storageClassAnnotationKey] = st.StorageClass
+	}
+	_, err = kclient.PersistentVolumeClaims(ns).Create(pvc)
+	if err != nil && !IsKubernetesResourceAlreadyExistError(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteClusterPVCs deletes the volume claims of all the servers of a cluster.
+func DeleteClusterPVCs(kclient *unversioned.Client, ns, clusterName string) error {
+	pvcs, err := kclient.PersistentVolumeClaims(ns).List(PodListOpt(clusterName))
+	if err != nil {
+		return err
+	}
+	for i := range pvcs.Items {
+		err := kclient.PersistentVolumeClaims(ns).Delete(pvcs.Items[i].Name)
+		if err != nil && !IsKubernetesResourceNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// podWithVolumeClaim mounts the volume claimed by name into the data
+// directory of the first container of the pod.
+func podWithVolumeClaim(pod *api.Pod, claimName, dataDir string) *api.Pod {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, api.Volume{
+		Name: dataVolumeName,
+		VolumeSource: api.VolumeSource{
+			PersistentVolumeClaim: &api.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+		},
+	})
+	c := &pod.Spec.Containers[0]
+	c.VolumeMounts = append(c.VolumeMounts, api.VolumeMount{Name: dataVolumeName, MountPath: dataDir})
+	return pod
+}
+
+// podWithEmptyDir mounts a volume sharing the lifetime of the pod into the
+// data directory of the first container of the pod.
+func podWithEmptyDir(pod *api.Pod, dataDir string) *api.Pod {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, api.Volume{
+		Name:         dataVolumeName,
+		VolumeSource: api.VolumeSource{EmptyDir: &api.EmptyDirVolumeSource{}},
+	})
+	c := &pod.Spec.Containers[0]
+	c.VolumeMounts = append(c.VolumeMounts, api.VolumeMount{Name: dataVolumeName, MountPath: dataDir})
+	return pod
+}
+
+// StorageClassChangedError tells that an existing storage class differs
+// from the one the operator is configured to create. The provisioner and
+// parameters of a storage class cannot be updated.
+type StorageClassChangedError struct {
+	Name        string
+	Provisioner string
+	Parameters  map[string]string
+}
+
+func (e *StorageClassChangedError) Error() string {
+	return fmt.Sprintf("storage class %q exists with provisioner %q and parameters %v", e.Name, e.Provisioner, e.Parameters)
+}
+
+// CreateStorageClass creates the storage class the operator provisions the
+// volumes of the NATS servers from, unless it already exists. An existing
+// storage class with another provisioner or parameters is reported by a
+// StorageClassChangedError.
+func CreateStorageClass(kclient *unversioned.Client, name, provisioner string, params map[string]string) error {
+	class := &storage.StorageClass{
+		ObjectMeta: api.ObjectMeta{
+			Name: name,
+		},
+		Provisioner: provisioner,
+		Parameters:  params,
+	}
+	_, err := kclient.StorageClasses().Create(class)
+	if err == nil {
+		return nil
+	}
+	if !IsKubernetesResourceAlreadyExistError(err) {
+		return err
+	}
+	old, err := kclient.StorageClasses().Get(name)
+	if err != nil {
+		return err
+	}
+	if old.Provisioner != provisioner || !sameParameters(old.Parameters, params) {
+		return &StorageClassChangedError{Name: name, Provisioner: old.Provisioner, Parameters: old.Parameters}
+	}
+	return nil
+}
+
+func sameParameters(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
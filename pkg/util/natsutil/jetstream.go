@@ -0,0 +1,237 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package natsutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const jsAPIPrefix = "$JS.API"
+
+var jsRequestTimeout = 5 * time.Second
+
+// ErrJetStreamNotFound is returned when a stream or consumer does not exist.
+var ErrJetStreamNotFound = errors.New("not found")
+
+// StreamConfig is the subset of the JetStream stream configuration managed
+// by the operator. Durations are in nanoseconds.
+type StreamConfig struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Subjects    []string `json:"subjects,omitempty"`
+	Retention   string   `json:"retention"`
+	Storage     string   `json:"storage"`
+	Replicas    int      `json:"num_replicas"`
+	MaxAge      int64    `json:"max_age"`
+	MaxBytes    int64    `json:"max_bytes"`
+	MaxMsgs     int64    `json:"max_msgs"`
+}
+
+// StreamInfo is the subset of the JetStream stream information used by the
+// operator.
+type StreamInfo struct {
+	Config StreamConfig `json:"config"`
+	State  struct {
+		Msgs      uint64 `json:"messages"`
+		Bytes     uint64 `json:"bytes"`
+		Consumers int    `json:"consumer_count"`
+	} `json:"state"`
+}
+
+// ConsumerConfig is the subset of the JetStream consumer configuration
+// managed by the operator. Durations are in nanoseconds.
+type ConsumerConfig struct {
+	Durable       string `json:"durable_name"`
+	Description   string `json:"description,omitempty"`
+	DeliverPolicy string `json:"deliver_policy"`
+	AckPolicy     string `json:"ack_policy"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+	MaxDeliver    int    `json:"max_deliver,omitempty"`
+	AckWait       int64  `json:"ack_wait,omitempty"`
+}
+
+// ConsumerInfo is the subset of the JetStream consumer information used by
+// the operator.
+type ConsumerInfo struct {
+	Config         ConsumerConfig `json:"config"`
+	NumPending     uint64         `json:"num_pending"`
+	NumAckPending  int            `json:"num_ack_pending"`
+	NumRedelivered int            `json:"num_redelivered"`
+}
+
+type jsAPIError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+type jsAPIResponse struct {
+	Error *jsAPIError `json:"error,omitempty"`
+}
+
+// JetStreamClient manages streams and consumers through the JetStream API
+// of a NATS cluster, which takes JSON requests on "$JS.API.>" subjects.
+type JetStreamClient struct {
+	nc *nats.Conn
+}
+
+// ConnectJetStream connects to the NATS cluster at url.
+func ConnectJetStream(url string, options ...nats.Option) (*JetStreamClient, error) {
+	options = append([]nats.Option{nats.Name("nats-operator"), nats.MaxReconnects(0)}, options...)
+	nc, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &JetStreamClient{nc: nc}, nil
+}
+
+func (c *JetStreamClient) Close() {
+	c.nc.Close()
+}
+
+// StreamInfo returns the stream with the given name, or ErrJetStreamNotFound.
+func (c *JetStreamClient) StreamInfo(name string) (*StreamInfo, error) {
+	si := &StreamInfo{}
+	if err := c.request("STREAM.INFO."+name, nil, si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// AddStream creates a stream.
+func (c *JetStreamClient) AddStream(cfg *StreamConfig) (*StreamInfo, error) {
+	si := &StreamInfo{}
+	if err := c.request("STREAM.CREATE."+cfg.Name, cfg, si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// UpdateStream updates the configuration of a stream.
+func (c *JetStreamClient) UpdateStream(cfg *StreamConfig) (*StreamInfo, error) {
+	si := &StreamInfo{}
+	if err := c.request("STREAM.UPDATE."+cfg.Name, cfg, si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// Streams returns the streams of the account.
+func (c *JetStreamClient) Streams() ([]StreamInfo, error) {
+	var streams []StreamInfo
+	for {
+		req := struct {
+			Offset int `json:"offset"`
+		}{len(streams)}
+		resp := struct {
+			Total   int          `json:"total"`
+			Streams []StreamInfo `json:"streams"`
+		}{}
+		if err := c.request("STREAM.LIST", req, &resp); err != nil {
+			return nil, err
+		}
+		streams = append(streams, resp.Streams...)
+		if len(resp.Streams) == 0 || len(streams) >= resp.Total {
+			return streams, nil
+		}
+	}
+}
+
+// DeleteStream deletes a stream and its messages.
+func (c *JetStreamClient) DeleteStream(name string) error {
+	return c.request("STREAM.DELETE."+name, nil, nil)
+}
+
+// ConsumerInfo returns the durable consumer of a stream, or
+// ErrJetStreamNotFound.
+func (c *JetStreamClient) ConsumerInfo(stream, durable string) (*ConsumerInfo, error) {
+	ci := &ConsumerInfo{}
+	if err := c.request(fmt.Sprintf("CONSUMER.INFO.%s.%s", stream, durable), nil, ci); err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
+
+// AddConsumer creates a durable consumer of a stream, or updates it if the
+// server allows the change.
+func (c *JetStreamClient) AddConsumer(stream string, cfg *ConsumerConfig) (*ConsumerInfo, error) {
+	req := struct {
+		Stream string          `json:"stream_name"`
+		Config *ConsumerConfig `json:"config"`
+	}{stream, cfg}
+	ci := &ConsumerInfo{}
+	if err := c.request(fmt.Sprintf("CONSUMER.DURABLE.CREATE.%s.%s", stream, cfg.Durable), req, ci); err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
+
+// Consumers returns the consumers of a stream.
+func (c *JetStreamClient) Consumers(stream string) ([]ConsumerInfo, error) {
+	var consumers []ConsumerInfo
+	for {
+		req := struct {
+			Offset int `json:"offset"`
+		}{len(consumers)}
+		resp := struct {
+			Total     int            `json:"total"`
+			Consumers []ConsumerInfo `json:"consumers"`
+		}{}
+		if err := c.request("CONSUMER.LIST."+stream, req, &resp); err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, resp.Consumers...)
+		if len(resp.Consumers) == 0 || len(consumers) >= resp.Total {
+			return consumers, nil
+		}
+	}
+}
+
+// DeleteConsumer deletes a durable consumer of a stream.
+func (c *JetStreamClient) DeleteConsumer(stream, durable string) error {
+	return c.request(fmt.Sprintf("CONSUMER.DELETE.%s.%s", stream, durable), nil, nil)
+}
+
+func (c *JetStreamClient) request(api string, req, resp interface{}) error {
+	var data []byte
+	if req != nil {
+		var err error
+		if data, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	msg, err := c.nc.Request(jsAPIPrefix+"."+api, data, jsRequestTimeout)
+	if err != nil {
+		return fmt.Errorf("%s: %v", api, err)
+	}
+	r := &jsAPIResponse{}
+	if err := json.Unmarshal(msg.Data, r); err != nil {
+		return fmt.Errorf("%s: invalid response: %v", api, err)
+	}
+	if r.Error != nil {
+		if r.Error.Code == 404 {
+			return ErrJetStreamNotFound
+		}
+		return fmt.Errorf("%s: %s (%d)", api, r.Error.Description, r.Error.Code)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.Data, resp)
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 The nats-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package natsutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fakod/nats-operator/pkg/constants"
+)
+
+var monitoringClient = &http.Client{Timeout: 3 * time.Second}
+
+// Varz is the subset of the NATS server /varz response used by the operator.
+type Varz struct {
+	ID            string    `json:"server_id"`
+	Version       string    `json:"version"`
+	Start         time.Time `json:"start"`
+	Uptime        string    `json:"uptime"`
+	Connections   int       `json:"connections"`
+	Routes        int       `json:"routes"`
+	InMsgs        int64     `json:"in_msgs"`
+	OutMsgs       int64     `json:"out_msgs"`
+	InBytes       int64     `json:"in_bytes"`
+	OutBytes      int64     `json:"out_bytes"`
+	SlowConsumers int64     `json:"slow_consumers"`
+}
+
+// Routez is the subset of the NATS server /routez response used by the operator.
+type Routez struct {
+	NumRoutes int         `json:"num_routes"`
+	Routes    []RouteInfo `json:"routes"`
+}
+
+// RouteInfo describes a single route of a NATS server.
+type RouteInfo struct {
+	RemoteID   string `json:"remote_id"`
+	DidSolicit bool   `json:"did_solicit"`
+	IP         string `json:"ip"`
+	Port       int    `json:"port"`
+}
+
+// Connz is the subset of the NATS server /connz response used by the operator.
+type Connz struct {
+	NumConns int `json:"num_connections"`
+	Total    int `json:"total"`
+}
+
+// Jsz is the subset of the NATS server /jsz response used by the operator.
+type Jsz struct {
+	Memory    uint64 `json:"memory"`
+	Storage   uint64 `json:"storage"`
+	Streams   int    `json:"streams"`
+	Consumers int    `json:"consumers"`
+	Messages  uint64 `json:"messages"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// GetVarz retrieves general information from the NATS server at host.
+func GetVarz(host string) (*Varz, error) {
+	v := &Varz{}
+	if err := getMonitoringEndpoint(host, "varz", v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// GetRoutez retrieves route information from the NATS server at host.
+func GetRoutez(host string) (*Routez, error) {
+	r := &Routez{}
+	if err := getMonitoringEndpoint(host, "routez", r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetConnz retrieves client connection information from the NATS server at host.
+func GetConnz(host string) (*Connz, error) {
+	c := &Connz{}
+	if err := getMonitoringEndpoint(host, "connz", c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetJsz retrieves JetStream information from the NATS server at host.
+func GetJsz(host string) (*Jsz, error) {
+	j := &Jsz{}
+	if err := getMonitoringEndpoint(host, "jsz", j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func getMonitoringEndpoint(host, endpoint string, v interface{}) error {
+	resp, err := monitoringClient.Get(fmt.Sprintf("http://%s:%d/%s", host, constants.MonitoringPort, endpoint))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code from /%s on %s: %v", endpoint, host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
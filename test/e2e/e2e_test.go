@@ -19,10 +19,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fakod/nats-operator/pkg/constants"
+	"github.com/fakod/nats-operator/pkg/spec"
 	"github.com/fakod/nats-operator/pkg/util/k8sutil"
 	"github.com/fakod/nats-operator/test/e2e/framework"
 
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/wait"
 )
 
 func TestCreateCluster(t *testing.T) {
@@ -62,8 +65,7 @@ func TestResizeCluster3to5(t *testing.T) {
 	}
 	fmt.Println("reached 3 peers cluster")
 
-	test.Spec.Size = 5
-	if _, err := updateCluster(f, test); err != nil {
+	if _, err := updateCluster(f, test.Name, func(cl *spec.NatsCluster) { cl.Spec.Size = 5 }); err != nil {
 		t.Fatal(err)
 	}
 
@@ -72,6 +74,38 @@ func TestResizeCluster3to5(t *testing.T) {
 	}
 }
 
+func TestBatchedResizeCluster3to7(t *testing.T) {
+	f := framework.Global
+	test, err := createCluster(f, makeClusterSpec("test-nats-", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := deleteCluster(f, test.Name); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, err := waitUntilSizeReached(f, test.Name, 3, 60*time.Second); err != nil {
+		t.Fatalf("failed to create 3 peers cluster: %v", err)
+		return
+	}
+	fmt.Println("reached 3 peers cluster")
+
+	_, err = updateCluster(f, test.Name, func(cl *spec.NatsCluster) {
+		cl.Spec.Size = 7
+		cl.Spec.ScaleUpBatchSize = 4
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := waitUntilSizeReached(f, test.Name, 7, 60*time.Second); err != nil {
+		t.Fatalf("failed to resize to 7 peers: %v", err)
+	}
+}
+
 func TestResizeCluster5to3(t *testing.T) {
 	f := framework.Global
 	test, err := createCluster(f, makeClusterSpec("test-nats-", 5))
@@ -91,8 +125,7 @@ func TestResizeCluster5to3(t *testing.T) {
 	}
 	fmt.Println("reached 5 peers cluster")
 
-	test.Spec.Size = 3
-	if _, err := updateCluster(f, test); err != nil {
+	if _, err := updateCluster(f, test.Name, func(cl *spec.NatsCluster) { cl.Spec.Size = 3 }); err != nil {
 		t.Fatal(err)
 	}
 
@@ -153,9 +186,8 @@ func TestNATSUpgrade(t *testing.T) {
 		t.Fatalf("failed to create 3 peers cluster: %v", err)
 	}
 
-	test = clusterWithVersion(test, newVersion)
-
-	if _, err := updateCluster(f, test); err != nil {
+	_, err = updateCluster(f, test.Name, func(cl *spec.NatsCluster) { clusterWithVersion(cl, newVersion) })
+	if err != nil {
 		t.Fatalf("fail to update cluster version: %v", err)
 	}
 
@@ -167,6 +199,84 @@ func TestNATSUpgrade(t *testing.T) {
 	}
 }
 
+// TestPodTemplateUpgrade tests a spec change other than the version is
+// rolled out to the existing NATS pods.
+func TestPodTemplateUpgrade(t *testing.T) {
+	f := framework.Global
+
+	test, err := createCluster(f, clusterWithVersion(makeClusterSpec("test-nats-", 3), constants.NatsVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := deleteCluster(f, test.Name); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, err := waitUntilSizeReached(f, test.Name, 3, 60*time.Second); err != nil {
+		t.Fatalf("failed to create 3 peers cluster: %v", err)
+	}
+
+	test, err = updateCluster(f, test.Name, func(cl *spec.NatsCluster) {
+		cl.Spec.Pod = &spec.PodPolicy{
+			ReadinessProbe: &spec.ProbePolicy{PeriodSeconds: 10},
+		}
+	})
+	if err != nil {
+		t.Fatalf("fail to update cluster pod policy: %v", err)
+	}
+
+	hash := k8sutil.PodTemplateHash(test.Name, &test.Spec)
+	_, err = waitSizeReachedWithFilter(f, test.Name, 3, 5*60*time.Second, func(pod *api.Pod) bool {
+		return k8sutil.GetPodTemplateHash(pod) == hash
+	})
+	if err != nil {
+		t.Fatalf("failed to wait for the new pod template: %v", err)
+	}
+}
+
+// TestMemberStatus tests the operator reports what each NATS server
+// exposes on its monitoring endpoint, and the health of the route mesh,
+// in the cluster status.
+func TestMemberStatus(t *testing.T) {
+	f := framework.Global
+	test, err := createCluster(f, makeClusterSpec("test-nats-", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := deleteCluster(f, test.Name); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, err := waitUntilSizeReached(f, test.Name, 3, 60*time.Second); err != nil {
+		t.Fatalf("failed to create 3 peers cluster: %v", err)
+	}
+
+	err = wait.Poll(5*time.Second, 60*time.Second, func() (bool, error) {
+		cl, err := getCluster(f, test.Name)
+		if err != nil {
+			return false, err
+		}
+		if len(cl.Status.Members) != 3 {
+			return false, nil
+		}
+		for _, m := range cl.Status.Members {
+			if len(m.ServerID) == 0 || m.Routes != 2 {
+				return false, nil
+			}
+		}
+		cond := cl.Status.GetCondition(spec.ClusterConditionMeshHealthy)
+		return cond != nil && cond.Status == api.ConditionTrue, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to wait for member status: %v", err)
+	}
+}
+
 // TestPauseControl tests the user can pause the operator from controlling
 // a NATS cluster.
 func TestPauseControl(t *testing.T) {
@@ -186,8 +296,7 @@ func TestPauseControl(t *testing.T) {
 		t.Fatalf("failed to create 3 peers cluster: %v", err)
 	}
 
-	test.Spec.Paused = true
-	if test, err = updateCluster(f, test); err != nil {
+	if _, err = updateCluster(f, test.Name, func(cl *spec.NatsCluster) { cl.Spec.Paused = true }); err != nil {
 		t.Fatalf("failed to pause control: %v", err)
 	}
 
@@ -206,8 +315,7 @@ func TestPauseControl(t *testing.T) {
 		t.Fatalf("cluster should not be recovered: control is paused")
 	}
 
-	test.Spec.Paused = false
-	if _, err = updateCluster(f, test); err != nil {
+	if _, err = updateCluster(f, test.Name, func(cl *spec.NatsCluster) { cl.Spec.Paused = false }); err != nil {
 		t.Fatalf("failed to resume control: %v", err)
 	}
 
@@ -215,3 +323,36 @@ func TestPauseControl(t *testing.T) {
 		t.Fatalf("failed to resize to 3 peers cluster: %v", err)
 	}
 }
+
+// TestStreamingCluster tests a NATS Streaming server is deployed on top of
+// a cluster with streaming enabled.
+func TestStreamingCluster(t *testing.T) {
+	f := framework.Global
+	cl := makeClusterSpec("test-nats-", 3)
+	cl.Spec.Streaming = &spec.StreamingPolicy{StoreType: spec.StoreTypeMemory}
+	test, err := createCluster(f, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := deleteCluster(f, test.Name); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, err := waitUntilSizeReached(f, test.Name, 3, 60*time.Second); err != nil {
+		t.Fatalf("failed to create 3 peers cluster: %v", err)
+	}
+
+	err = wait.Poll(5*time.Second, 2*60*time.Second, func() (bool, error) {
+		cl, err := getCluster(f, test.Name)
+		if err != nil {
+			return false, err
+		}
+		cond := cl.Status.GetCondition(spec.ClusterConditionStreamingReady)
+		return cond != nil && cond.Status == api.ConditionTrue, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to wait for the streaming server: %v", err)
+	}
+}
@@ -117,7 +117,7 @@ func (f *Framework) setupOperator(opImage string) error {
 		},
 	}
 
-	err := k8sutil.CreateAndWaitPod(f.KubeClient, f.Namespace.Name, pod, 60*time.Second)
+	_, err := k8sutil.CreateAndWaitPod(f.KubeClient, f.Namespace.Name, pod, 60*time.Second)
 	if err != nil {
 		return err
 	}
@@ -17,6 +17,7 @@ package e2e
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -132,8 +133,34 @@ func createCluster(f *framework.Framework, e *spec.NatsCluster) (*spec.NatsClust
 	return res, nil
 }
 
-func updateCluster(f *framework.Framework, e *spec.NatsCluster) (*spec.NatsCluster, error) {
-	fmt.Printf("updating NATS cluster: %v\n", e.ClusterName)
+// updateCluster applies the update to the current cluster object and
+// replaces it, retrying on conflicts with the status updates of the
+// operator.
+func updateCluster(f *framework.Framework, name string, update func(*spec.NatsCluster)) (*spec.NatsCluster, error) {
+	fmt.Printf("updating NATS cluster: %v\n", name)
+	var res *spec.NatsCluster
+	err := wait.Poll(time.Second, 30*time.Second, func() (bool, error) {
+		cl, err := getCluster(f, name)
+		if err != nil {
+			return false, err
+		}
+		update(cl)
+		res, err = putCluster(f, cl)
+		if err == errConflict {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("updated NATS cluster: %v\n", res.Name)
+	return res, nil
+}
+
+var errConflict = errors.New("conflict")
+
+func putCluster(f *framework.Framework, e *spec.NatsCluster) (*spec.NatsCluster, error) {
 	b, err := json.Marshal(e)
 	if err != nil {
 		return nil, err
@@ -150,6 +177,9 @@ func updateCluster(f *framework.Framework, e *spec.NatsCluster) (*spec.NatsClust
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, errConflict
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status: %v", resp.Status)
 	}
@@ -158,9 +188,24 @@ func updateCluster(f *framework.Framework, e *spec.NatsCluster) (*spec.NatsClust
 	if err := decoder.Decode(res); err != nil {
 		return nil, err
 	}
+	return res, nil
+}
 
-	fmt.Printf("updated NATS cluster: %v\n", res.Name)
-
+func getCluster(f *framework.Framework, name string) (*spec.NatsCluster, error) {
+	resp, err := f.KubeClient.Client.Get(
+		fmt.Sprintf("%s/apis/nats.io/v1/namespaces/%s/natsclusters/%s", f.MasterHost, f.Namespace.Name, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	res := &spec.NatsCluster{}
+	if err := decoder.Decode(res); err != nil {
+		return nil, err
+	}
 	return res, nil
 }
 